@@ -0,0 +1,134 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// archiveName matches the files certbot keeps in archive/<lineage>.
+var archiveName = regexp.MustCompile(`^fullchain([0-9]+)\.pem$`)
+
+// previousChain returns the chain of the archive generation before the one
+// the lineage links to, ordered from the end entity, or nil if there is none.
+// The fullchain.pem of a certbot lineage links to
+// archive/<lineage>/fullchainN.pem.
+func previousChain(lineage string) ([]*x509.Certificate, error) {
+	target, err := filepath.EvalSymlinks(filepath.Join(filepath.Clean(lineage), "fullchain.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	m := archiveName.FindStringSubmatch(filepath.Base(target))
+	if m == nil {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n < 2 {
+		return nil, nil
+	}
+
+	f := filepath.Join(filepath.Dir(target), fmt.Sprintf("fullchain%d.pem", n-1))
+	data, err := os.ReadFile(f)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for b, r := pem.Decode(data); b != nil; b, r = pem.Decode(r) {
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		certs = append(certs, c)
+	}
+	chain, _ := buildChain(certs)
+	return chain, nil
+}
+
+// previousRecords returns the records cdh published for the previous chain
+// prev, its end entity and the trust anchors the policy selects, that are
+// not among the records of t.
+func previousRecords(t *tlsa, prev []*x509.Certificate, o certOptions) ([]tlsaRecord, error) {
+	if len(prev) == 0 {
+		return nil, nil
+	}
+
+	p := NewTLSA(o.Params...)
+	if err := p.ReadCert(prev[0]); err != nil {
+		return nil, err
+	}
+	// A CA may have moved on, so trust anchors the policy no longer
+	// selects are not known to be ours.
+	if tas, err := o.Policy.Select(prev); err == nil {
+		for _, c := range tas {
+			if err = p.ReadCert(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	current := make(map[tlsaRecord]bool)
+	for _, r := range t.Records {
+		current[r] = true
+	}
+	var records []tlsaRecord
+	for _, r := range p.Records {
+		if r.Data != "" && !current[r] {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// addEndEntity adds the end entity records of c to t, unless t already has
+// the same data, and returns how many it added.
+func addEndEntity(t *tlsa, c *x509.Certificate) (int, error) {
+	n := 0
+	for _, r := range t.Records {
+		if !r.EndEntity() {
+			continue
+		}
+		data, err := dns.CertificateToDANE(r.Selector, r.MatchingType, c)
+		if err != nil {
+			return 0, err
+		}
+
+		dup := false
+		for _, o := range t.Records {
+			dup = dup || (o.tlsaParams == r.tlsaParams && o.Data == data)
+		}
+		if !dup {
+			t.Records = append(t.Records, tlsaRecord{r.tlsaParams, data})
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeArchive lays out a certbot lineage with one archive generation per
+// leaf and returns the live directory of the lineage.
+func writeArchive(t *testing.T, inter *x509.Certificate, leaves ...*x509.Certificate) string {
+	root := t.TempDir()
+	archive := filepath.Join(root, "archive", "example.com")
+	live := filepath.Join(root, "live", "example.com")
+	assert.NoError(t, os.MkdirAll(archive, 0o755), "Expected no error")
+	assert.NoError(t, os.MkdirAll(live, 0o755), "Expected no error")
+
+	for i, leaf := range leaves {
+		var data []byte
+		for _, c := range []*x509.Certificate{leaf, inter} {
+			data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		f := filepath.Join(archive, fmt.Sprintf("fullchain%d.pem", i+1))
+		assert.NoError(t, os.WriteFile(f, data, 0o644), "Expected no error")
+	}
+
+	target := filepath.Join("..", "..", "archive", "example.com", fmt.Sprintf("fullchain%d.pem", len(leaves)))
+	assert.NoError(t, os.Symlink(target, filepath.Join(live, "fullchain.pem")), "Expected no error")
+	return live
+}
+
+func TestPreviousChain(t *testing.T) {
+	c := newTestChain(t)
+	old := newTestCert(t, "example.com", false, c.Inter, nil)
+
+	prev, err := previousChain(writeArchive(t, c.Inter.Cert, old.Cert, c.Leaf.Cert))
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*x509.Certificate{old.Cert, c.Inter.Cert}, prev, "Expected chain of the previous generation")
+
+	prev, err = previousChain(writeArchive(t, c.Inter.Cert, c.Leaf.Cert))
+	assert.NoError(t, err, "Expected no error")
+	assert.Nil(t, prev, "Expected no previous generation")
+
+	prev, err = previousChain(writeFullchain(t, c.Leaf.Cert, c.Inter.Cert))
+	assert.NoError(t, err, "Expected no error")
+	assert.Nil(t, prev, "Expected no archive outside of certbot")
+}
+
+func TestReadCertGrace(t *testing.T) {
+	c := newTestChain(t)
+	old := newTestCert(t, "example.com", false, c.Inter, nil)
+	live := writeArchive(t, c.Inter.Cert, old.Cert, c.Leaf.Cert)
+
+	now := c.Leaf.Cert.NotBefore.Add(time.Hour)
+	d, err := readCert(live, certOptions{Grace: 2 * time.Hour, Now: now})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{
+		"3 1 1 " + spkiHash(c.Leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+		"3 1 1 " + spkiHash(old.Cert),
+	}, d.MakeRRData(), "Expected previous key within the grace window")
+
+	d, err = readCert(live, certOptions{Grace: 30 * time.Minute, Now: now})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{
+		"3 1 1 " + spkiHash(c.Leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+	}, d.MakeRRData(), "Expected previous key to be dropped after the grace window")
+
+	// A renewal that reused the key adds nothing.
+	reused := newTestCert(t, "example.com", false, c.Inter, c.Leaf.Key)
+	d, err = readCert(writeArchive(t, c.Inter.Cert, c.Leaf.Cert, reused.Cert), certOptions{Grace: 2 * time.Hour, Now: now})
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, d.MakeRRData(), 2, "Expected reused key to be published once")
+}
+
+func TestReadCertPrevious(t *testing.T) {
+	c := newTestChain(t)
+	old := newTestCert(t, "example.com", false, c.Inter, nil)
+	live := writeArchive(t, c.Inter.Cert, old.Cert, c.Leaf.Cert)
+
+	d, err := readCert(live, certOptions{})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []tlsaRecord{
+		{tlsaParams{3, 1, 1}, spkiHash(old.Cert)},
+	}, d.Previous, "Expected only the previous key to be retired")
+
+	d, err = readCert(writeFullchain(t, c.Leaf.Cert, c.Inter.Cert), certOptions{})
+	assert.NoError(t, err, "Expected no error")
+	assert.Empty(t, d.Previous, "Expected nothing to retire outside of certbot")
+}
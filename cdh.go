@@ -19,19 +19,18 @@ package main
 import (
 	"context"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sethvargo/go-envconfig"
-	gcdns "google.golang.org/api/dns/v1"
-	"google.golang.org/api/option"
 )
 
 // config holds the configuration values for the application, including
@@ -41,28 +40,124 @@ type config struct {
 	Cert    string   `env:"RENEWED_LINEAGE"`
 }
 
+// tlsaParams is the usage, selector and matching type of a TLSA record.
+type tlsaParams struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+}
+
+// String returns the parameters in presentation format, such as "3 1 1".
+func (p tlsaParams) String() string {
+	return fmt.Sprintf("%d %d %d", p.Usage, p.Selector, p.MatchingType)
+}
+
+// EndEntity reports whether the parameters match the end entity certificate
+// (PKIX-EE or DANE-EE) rather than a CA certificate (PKIX-TA or DANE-TA).
+func (p tlsaParams) EndEntity() bool {
+	return p.Usage == 1 || p.Usage == 3
+}
+
+// parseTLSAParams parses parameters such as "3 1 1".
+func parseTLSAParams(s string) (tlsaParams, error) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return tlsaParams{}, fmt.Errorf("TLSA parameters %q are not in \"usage selector type\" form", s)
+	}
+
+	var v [3]uint8
+	for i, limit := range []uint64{3, 1, 2} {
+		n, err := strconv.ParseUint(f[i], 10, 8)
+		if err != nil || n > limit {
+			return tlsaParams{}, fmt.Errorf("unsupported TLSA parameters %q", s)
+		}
+		v[i] = uint8(n)
+	}
+
+	return tlsaParams{Usage: v[0], Selector: v[1], MatchingType: v[2]}, nil
+}
+
+// tlsaParamsList is a list of TLSA parameters given as repeated -t flags.
+type tlsaParamsList []tlsaParams
+
+// String returns the parameters separated by commas.
+func (l *tlsaParamsList) String() string {
+	s := make([]string, 0, len(*l))
+	for _, p := range *l {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses parameters and appends them to the list. A tuple given twice
+// is refused.
+func (l *tlsaParamsList) Set(v string) error {
+	p, err := parseTLSAParams(v)
+	if err != nil {
+		return err
+	}
+	for _, o := range *l {
+		if o == p {
+			return fmt.Errorf("TLSA parameters %q given twice", v)
+		}
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+// defaultTLSAParams are published when no -t flag is given.
+var defaultTLSAParams = tlsaParamsList{{3, 1, 1}, {2, 1, 1}}
+
+// tlsaRecord is the data of one TLSA record.
+type tlsaRecord struct {
+	tlsaParams
+	Data string
+}
+
+// String returns the record data in presentation format.
+func (r tlsaRecord) String() string {
+	return fmt.Sprintf("%s %s", r.tlsaParams, r.Data)
+}
+
 // tlsa represents the DANE (DNS-based Authentication of Named Entities)
-// information for a certificate, including the trust anchor, end entity,
-// and associated DNS names.
+// information for a certificate: one record per configured parameter tuple,
+// the associated DNS names and the public key of the end entity. Previous
+// holds the records of the previous certificate that the renewal retires.
 type tlsa struct {
-	TrustAnchor string
-	EndEntity   string
-	DNSNames    []string
+	Records  []tlsaRecord
+	DNSNames []string
+	Key      []byte
+	Previous []tlsaRecord
 }
 
-// NewTLSA creates a new instance of the tlsa struct with initialized DNSNames slice.
-// It returns a pointer to the newly created tlsa instance.
-func NewTLSA() *tlsa {
+// NewTLSA creates a new instance of the tlsa struct with one empty record
+// for each of the given parameters, or the default parameters if none are
+// given. Repeated parameters get a single record. It returns a pointer to
+// the newly created tlsa instance.
+func NewTLSA(params ...tlsaParams) *tlsa {
+	if len(params) == 0 {
+		params = defaultTLSAParams
+	}
+
 	var t tlsa
 	t.DNSNames = make([]string, 0)
+	seen := make(map[tlsaParams]bool)
+	for _, p := range params {
+		if !seen[p] {
+			seen[p] = true
+			t.Records = append(t.Records, tlsaRecord{tlsaParams: p})
+		}
+	}
 	return &t
 }
 
-// ReadCert processes an x509.Certificate and populates the tlsa struct with
-// the appropriate DANE (DNS-based Authentication of Named Entities) information.
-// If the certificate is a CA (Certificate Authority), it sets the TrustAnchor field.
-// Otherwise, it sets the EndEntity field and processes the DNS names associated
-// with the certificate, ensuring each DNS name ends with a dot.
+// ReadCert processes an x509.Certificate and populates the tlsa struct with the
+// appropriate DANE (DNS-based Authentication of Named Entities) information. If
+// the certificate is a CA (Certificate Authority), it fills the trust anchor
+// records, adding another record for each parameter tuple that is already
+// filled with other data. Otherwise, it fills the end entity records and
+// processes the DNS names associated with the certificate, ensuring each DNS
+// name ends with a dot, and keeps its public key.
 //
 // Parameters:
 //   - c: A pointer to an x509.Certificate to be processed.
@@ -70,12 +165,37 @@ func NewTLSA() *tlsa {
 // Returns:
 //   - error: An error if the conversion to DANE fails, otherwise nil.
 func (t *tlsa) ReadCert(c *x509.Certificate) error {
-	if dane, err := dns.CertificateToDANE(1, 1, c); err != nil {
-		return err
-	} else if c.IsCA {
-		t.TrustAnchor = dane
-	} else {
-		t.EndEntity = dane
+	seen := make(map[tlsaParams]bool)
+	for i := 0; i < len(t.Records); i++ {
+		r := &t.Records[i]
+		if r.EndEntity() == c.IsCA || seen[r.tlsaParams] {
+			continue
+		}
+		seen[r.tlsaParams] = true
+
+		dane, err := dns.CertificateToDANE(r.Selector, r.MatchingType, c)
+		if err != nil {
+			return err
+		}
+		if !c.IsCA || r.Data == "" {
+			r.Data = dane
+			continue
+		}
+
+		// Add the trust anchor after the last record with the same tuple,
+		// unless one of them already has the same data.
+		j, dup := i, false
+		for ; j < len(t.Records) && t.Records[j].tlsaParams == r.tlsaParams; j++ {
+			dup = dup || t.Records[j].Data == dane
+		}
+		if dup {
+			continue
+		}
+		t.Records = append(t.Records[:j], append([]tlsaRecord{{r.tlsaParams, dane}}, t.Records[j:]...)...)
+	}
+
+	if !c.IsCA {
+		t.Key = c.RawSubjectPublicKeyInfo
 		for _, d := range c.DNSNames {
 			// Adds dot for DNS
 			if !strings.HasSuffix(d, ".") {
@@ -89,133 +209,368 @@ func (t *tlsa) ReadCert(c *x509.Certificate) error {
 }
 
 // MakeRRData generates the resource record data for the TLSA record.
-// It returns a slice of strings containing the TLSA record data.
+// It returns a slice of strings containing the TLSA record data, leaving
+// out records without data.
 func (t tlsa) MakeRRData() []string {
-	r := []string{
-		fmt.Sprintf(
-			"3 1 1 %s",
-			t.EndEntity,
-		),
-		fmt.Sprintf(
-			"2 1 1 %s",
-			t.TrustAnchor,
-		),
+	r := make([]string, 0, len(t.Records))
+	for _, rec := range t.Records {
+		if rec.Data != "" {
+			r = append(r, rec.String())
+		}
 	}
 
 	return r
 }
 
+// Check returns an error naming the parameter tuples that no certificate
+// of the chain provided data for.
+func (t tlsa) Check() error {
+	var missing []string
+	for _, rec := range t.Records {
+		if rec.Data != "" {
+			continue
+		}
+		if rec.EndEntity() {
+			missing = append(missing, rec.tlsaParams.String()+" (no end entity certificate)")
+		} else {
+			missing = append(missing, rec.tlsaParams.String()+" (no CA certificate selected)")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot derive TLSA records %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 var (
-	keyPath, zone string
+	keyPath, zone, providerName string
+	providerOpts                = options{}
+	certOpts                    certOptions
+	changeOpts                  changeOptions
+	rolloverFile                string
+	rolloverHold                time.Duration
 )
 
-// readCert reads the certificate from the specified file path and returns
-// a tlsa struct populated with the DANE information. It returns an error
-// if the certificate cannot be read or processed.
-func readCert(f string) (*tlsa, error) {
-	t := NewTLSA()
+// certOptions controls which records readCert derives from the chain.
+type certOptions struct {
+	Params       tlsaParamsList
+	Policy       taPolicy
+	Siblings     string
+	SaveSiblings bool
+	Grace        time.Duration
+	Now          time.Time
+	Revoked      revokedKeys
+}
+
+// changeOptions controls how newChange updates the TLSA RRsets.
+type changeOptions struct {
+	Services       serviceMap
+	Merge          bool
+	Pins           pinList
+	Registry       bool
+	RegistryPrefix string
+	Lineage        string
+	Now            time.Time
+	Rollover       *rollover
+}
+
+// readCert reads the certificate from the specified file path and returns a
+// tlsa struct populated with the DANE information. The chain is ordered by
+// signature and the trust anchors are chosen by the policy, then joined by the
+// sibling intermediates if a directory is set, leaving out those expired at
+// Now. Only the update of a renewed lineage sets SaveSiblings, which saves new
+// trust anchors to the directory and removes the expired ones. With a grace
+// window, the end entity records of the previous archive generation are kept
+// until it has passed, at Now, since the certificate was issued. Certificates
+// with a revoked key are left out. It returns an error if the certificate
+// cannot be read or processed, has a revoked key, or if a configured record
+// cannot be derived from the chain.
+func readCert(f string, o certOptions) (*tlsa, error) {
+	t := NewTLSA(o.Params...)
 
 	data, err := os.ReadFile(filepath.Join(filepath.Clean(f), "fullchain.pem"))
 	if err != nil {
 		return nil, err
 	}
 
+	var certs []*x509.Certificate
 	for b, r := pem.Decode(data); b != nil; b, r = pem.Decode(r) {
 		cert, err := x509.ParseCertificate(b.Bytes)
 		if err != nil {
 			return nil, err
 		}
-		err = t.ReadCert(cert)
-		if err != nil {
-			return nil, err
-		}
+		certs = append(certs, cert)
 	}
 
-	return t, nil
-}
-
-// newDNSClient reads a JSON key file and returns a DNS client, the project ID,
-// and any error that occurred.
-func newDNSClient(f string) (*gcdns.Service, string, error) {
-	var projectID string
-	var err error
-
-	data, err := os.ReadFile(filepath.Clean(f))
-	if err != nil {
-		return nil, projectID, err
+	chain, rest := buildChain(certs)
+	for _, c := range rest {
+		log.Printf("%s is not part of the chain, ignoring it", c.Subject)
 	}
 
-	var info map[string]string
-	err = json.Unmarshal(data, &info)
+	tas, err := o.Policy.Select(chain)
 	if err != nil {
-		return nil, projectID, err
+		return nil, err
+	}
+	if o.Siblings != "" {
+		siblings, err := readSiblings(o.Siblings, o.Now)
+		if err != nil {
+			return nil, err
+		}
+		if o.SaveSiblings {
+			if err = saveSiblings(o.Siblings, siblings, tas, o.Now); err != nil {
+				return nil, err
+			}
+		}
+		tas = addSiblings(siblings, tas)
 	}
-	if p, ok := info["project_id"]; ok {
-		projectID = p
+	if len(chain) > 0 {
+		if o.Revoked.Cert(chain[0]) {
+			return nil, fmt.Errorf("%s: the key of the certificate is revoked, renew it with a new key", f)
+		}
+		if err = t.ReadCert(chain[0]); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range tas {
+		if o.Revoked.Cert(c) {
+			log.Printf("the key of %s is revoked, leaving it out", c.Subject)
+			continue
+		}
+		if err = t.ReadCert(c); err != nil {
+			return nil, err
+		}
 	}
 
-	dnsSer, err := gcdns.NewService(
-		context.Background(),
-		option.WithCredentialsJSON(data),
-		option.WithScopes(gcdns.NdevClouddnsReadwriteScope),
-	)
-	if err != nil {
-		return nil, projectID, err
+	// Keep the previous certificate of the archive for the grace window, and
+	// note the records it retires
+	if len(chain) > 0 {
+		prev, err := previousChain(f)
+		if err != nil {
+			return nil, err
+		}
+		until := chain[0].NotBefore.Add(o.Grace)
+		if o.Grace > 0 && len(prev) > 0 && !o.Revoked.Cert(prev[0]) && o.Now.Before(until) {
+			n, err := addEndEntity(t, prev[0])
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				log.Printf("keeping the records of the previous certificate %s until %s", prev[0].SerialNumber, until.Format(time.RFC3339))
+			}
+		}
+		if t.Previous, err = previousRecords(t, prev, o); err != nil {
+			return nil, err
+		}
 	}
 
-	return dnsSer, projectID, nil
+	if err = t.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", f, err)
+	}
+
+	return t, nil
 }
 
-// newChange creates a new DNS change set based on the provided resource record sets
-// and the tlsa struct. It returns a pointer to the created gcdns.Change struct.
-func newChange(rR []*gcdns.ResourceRecordSet, t *tlsa) *gcdns.Change {
-	cset := gcdns.Change{}
+// newChange creates a new changeset based on the provided resource record sets
+// and the tlsa struct. Each DNS name gets a TLSA RRset for every service
+// the map gives it. In merge mode, or with pinned keys, the records of an
+// existing RRset that cdh did not publish are kept. With the registry, only the
+// records it lists for the lineage are retired, and the registry is updated
+// along with the RRset. Other TLSA RRsets of the names, and those whose owner
+// is not a _port._proto name, are left alone and returned so they can be
+// reported. RRsets whose records stay the same are left out of the change.
+func newChange(rR []*rrset, t *tlsa, o changeOptions) (*changeset, []*rrset) {
+	cset := changeset{}
+	var unmanaged []*rrset
+
+	hosts := make(map[string]bool)
+	for _, dnsName := range t.DNSNames {
+		hosts[strings.ToLower(dns.Fqdn(dnsName))] = true
+	}
 
-	// Build a map of resource record sets
-	recordMap := make(map[string][]*gcdns.ResourceRecordSet)
+	// Index the TLSA resource record sets of the names by owner
+	existing := make(map[string]*rrset)
+	all := make(map[string]*rrset)
+	registry := make(map[string]*rrset)
 	for _, r := range rR {
-		if r.Type == "TLSA" {
-			domain := strings.SplitN(r.Name, ".", 3)[2] // Remove the TLSA prefix from the domain name
-			recordMap[domain] = append(recordMap[domain], r)
+		if r.Type == "TXT" {
+			registry[strings.ToLower(r.Name)] = r
+		}
+		if r.Type != "TLSA" {
+			continue
+		}
+		all[strings.ToLower(r.Name)] = r
+		svc, host, err := parseOwner(r.Name)
+		if err != nil {
+			unmanaged = append(unmanaged, r)
+			continue
+		}
+		host = strings.ToLower(host)
+		if !hosts[host] {
+			continue
+		}
+		if !containsService(o.Services.Lookup(host), svc) {
+			unmanaged = append(unmanaged, r)
+			continue
 		}
+		existing[strings.ToLower(svc.Owner(host))] = r
 	}
 
 	for _, dnsName := range t.DNSNames {
-		// Check if the DNS name exists in the map
-		if rList, ok := recordMap[dnsName]; ok {
-			for _, r := range rList {
-				// Append the original record to cset.Deletions
-				cset.Deletions = append(cset.Deletions, r)
-
-				// Create a new resource record set with updated Rrdatas
-				newRecord := &gcdns.ResourceRecordSet{
-					Kind:    r.Kind,
-					Name:    r.Name,
-					Ttl:     r.Ttl,
-					Type:    r.Type,
-					Rrdatas: t.MakeRRData(),
-				}
-				cset.Additions = append(cset.Additions, newRecord)
-			}
-		} else {
-			// Create a new resource record set with default values
-			newRecord := &gcdns.ResourceRecordSet{
-				Kind:    "dns#resourceRecordSet",
-				Name:    "_443._tcp." + dnsName,
-				Ttl:     300,
+		for _, svc := range o.Services.Lookup(dnsName) {
+			name := svc.Owner(dnsName)
+			newRecord := &rrset{
+				Name:    name,
 				Type:    "TLSA",
+				TTL:     300,
 				Rrdatas: t.MakeRRData(),
 			}
-			cset.Additions = append(cset.Additions, newRecord)
+
+			// Replace the existing resource record set, keeping its TTL
+			r, ok := existing[strings.ToLower(name)]
+			if ok {
+				newRecord.Name, newRecord.TTL = r.Name, r.TTL
+				switch {
+				case o.Registry:
+					// Merged with the registry below
+				case o.Merge || len(o.Pins) > 0:
+					newRecord.Rrdatas = mergeRRData(r, t, o)
+				default:
+					newRecord.Rrdatas = holdRRData(r, newRecord.Rrdatas, o.Rollover)
+				}
+				delete(existing, strings.ToLower(name))
+			}
+			o.Rollover.Forget(newRecord.Name, t.MakeRRData())
+
+			if !o.Registry {
+				cset.Replace(r, newRecord)
+				continue
+			}
+			regName := registryOwner(newRecord.Name, o.RegistryPrefix)
+			txt := &rrset{Name: regName, Type: "TXT", TTL: newRecord.TTL}
+			reg, ok := registry[strings.ToLower(regName)]
+			var entries []string
+			if ok {
+				txt.Name, txt.TTL, entries = reg.Name, reg.TTL, reg.Rrdatas
+				delete(registry, strings.ToLower(regName))
+			}
+			newRecord.Rrdatas, txt.Rrdatas = registryRRData(r, entries, t, o)
+			cset.Replace(r, newRecord)
+			cset.Replace(reg, txt)
 		}
 	}
 
-	return &cset
+	if o.Registry {
+		retireLineage(&cset, rR, all, registry, o)
+	}
+
+	return &cset, unmanaged
+}
+
+// commands maps subcommand names to their entry points. Running cdh without
+// a subcommand updates the TLSA records of the renewed certificate.
+var commands = map[string]func(args []string) error{
+	"gc":     gc,
+	"keygen": keygen,
+	"revoke": revoke,
+	"stage":  stage,
+}
+
+// registerFlags defines the flags of the update on fs.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&providerName, "p", "gcloud", "name of the DNS provider")
+	fs.StringVar(&keyPath, "k", "", "path to the provider key file")
+	fs.StringVar(&zone, "z", "", "name of the DNS zone")
+	fs.Var(providerOpts, "o", "provider option in name=value form, may be repeated")
+	fs.Var(&certOpts.Policy, "a", "trust anchor policy: issuer, top, all, subject=name or spki=sha256")
+	fs.DurationVar(&certOpts.Grace, "e", 0, "grace window to keep the previous archived certificate published after a renewal")
+	fs.StringVar(&certOpts.Siblings, "i", "", "directory of sibling intermediate certificates to publish as trust anchors")
+	fs.StringVar(&rolloverFile, "f", "", "rollover state file, keeps retired records for the hold period, staged and revoked keys")
+	fs.DurationVar(&rolloverHold, "w", 0, "hold period of retired records, twice the TTL by default")
+	fs.BoolVar(&changeOpts.Registry, "r", false, "keep a registry of the records cdh published in TXT records")
+	fs.StringVar(&changeOpts.RegistryPrefix, "x", "", "prefix of the registry owner names, implies -r")
+	fs.Var(&changeOpts.Pins, "b", "SPKI SHA-256 digest of a pinned key whose records are kept, may be repeated")
+	fs.BoolVar(&changeOpts.Merge, "m", false, "keep the records of existing RRsets that cdh did not publish")
+	fs.Var(&changeOpts.Services, "s", "services of matching names in pattern=port/proto,... form, may be repeated")
+	fs.Var(&certOpts.Params, "t", "TLSA usage, selector and matching type such as \"3 1 1\", may be repeated")
+}
+
+// loadState sets the time of the run and reads the rollover state file of
+// the zone, if one is given, with the keys that must not be published.
+func loadState() error {
+	var err error
+
+	now := time.Now()
+	certOpts.Now, changeOpts.Now = now, now
+	if rolloverFile != "" {
+		if changeOpts.Rollover, err = loadRollover(rolloverFile, zone, rolloverHold, now); err != nil {
+			return err
+		}
+		certOpts.Revoked = changeOpts.Rollover.revoked
+	}
+	return nil
+}
+
+// update publishes the TLSA records of t, derived from the certificate of
+// lineage, along with those of the keys staged for it, with the configured
+// provider. The state must have been loaded.
+func update(ctx context.Context, lineage string, t *tlsa) error {
+	changeOpts.Registry = changeOpts.Registry || changeOpts.RegistryPrefix != ""
+	changeOpts.Lineage = filepath.Base(lineage)
+	changeOpts.Rollover.AddStaged(t, changeOpts.Lineage)
+
+	p, err := newProvider(ctx, providerName, providerConfig{
+		Zone:    zone,
+		KeyFile: keyPath,
+		Options: providerOpts,
+	})
+	if err != nil {
+		return err
+	}
+
+	records, err := p.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	cset, unmanaged := newChange(records, t, changeOpts)
+	for _, r := range unmanaged {
+		log.Printf("%s is not a configured service, leaving it alone", r.Name)
+	}
+
+	// A held record may start its hold period without changing the RRset.
+	if cset.Empty() {
+		fmt.Println("unchanged")
+		return changeOpts.Rollover.Save()
+	}
+
+	id, err := p.Apply(ctx, cset)
+	if err != nil {
+		return err
+	}
+
+	if err = p.Wait(ctx, id); err != nil {
+		return err
+	}
+
+	if err = changeOpts.Rollover.Save(); err != nil {
+		return err
+	}
+
+	fmt.Println("done")
+	return nil
 }
 
 func main() {
-	flag.StringVar(&keyPath, "k", "", "path to the Google Cloud key file")
-	flag.StringVar(&zone, "z", "", "name of the DNS zone")
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	registerFlags(flag.CommandLine)
 	flag.Parse()
 
 	var err error
@@ -229,27 +584,17 @@ func main() {
 
 	log.Println(cfg)
 
-	domains, err := readCert(cfg.Cert)
-	if err != nil {
+	if err = loadState(); err != nil {
 		log.Fatal(err)
 	}
 
-	dnsService, project, err := newDNSClient(keyPath)
+	certOpts.SaveSiblings = true
+	domains, err := readCert(cfg.Cert, certOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	records, err := dnsService.ResourceRecordSets.List(project, zone).Do()
-	if err != nil {
+	if err = update(ctx, cfg.Cert, domains); err != nil {
 		log.Fatal(err)
 	}
-
-	cset := newChange(records.Rrsets, domains)
-
-	change, err := dnsService.Changes.Create(project, zone, cset).Do()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	fmt.Println(change.Status)
 }
@@ -2,18 +2,65 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
+// testTLSA returns a tlsa with a 3 1 1 record for ee and a 2 1 1 record
+// for ta.
+func testTLSA(ee, ta string, names ...string) *tlsa {
+	return &tlsa{
+		Records: []tlsaRecord{
+			{tlsaParams{3, 1, 1}, ee},
+			{tlsaParams{2, 1, 1}, ta},
+		},
+		DNSNames: names,
+	}
+}
+
 func TestNewTLSA(t *testing.T) {
 	tlsa := NewTLSA()
 
 	assert.NotNil(t, tlsa, "Expected non-nil tlsa")
 	assert.Empty(t, tlsa.DNSNames, "Expected DNSNames to be empty")
-	assert.Equal(t, "", tlsa.TrustAnchor, "Expected TrustAnchor to be empty")
-	assert.Equal(t, "", tlsa.EndEntity, "Expected EndEntity to be empty")
+	assert.Equal(t, []tlsaRecord{
+		{tlsaParams{3, 1, 1}, ""},
+		{tlsaParams{2, 1, 1}, ""},
+	}, tlsa.Records, "Expected empty default records")
+
+	tlsa = NewTLSA(tlsaParams{3, 0, 2})
+	assert.Equal(t, []tlsaRecord{{tlsaParams{3, 0, 2}, ""}}, tlsa.Records, "Expected configured records")
+}
+
+func TestParseTLSAParams(t *testing.T) {
+	for s, want := range map[string]tlsaParams{
+		"3 1 1":   {3, 1, 1},
+		"3 0 1":   {3, 0, 1},
+		"2 0 2":   {2, 0, 2},
+		" 3 1 0 ": {3, 1, 0},
+		"1 1 1":   {1, 1, 1},
+		"0 0 1":   {0, 0, 1},
+	} {
+		p, err := parseTLSAParams(s)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, want, p, "Expected %q to parse", s)
+	}
+
+	for _, s := range []string{"", "3 1", "3 1 1 1", "3 2 1", "3 1 3", "4 1 1", "3 x 1"} {
+		_, err := parseTLSAParams(s)
+		assert.Error(t, err, "Expected %q to be refused", s)
+	}
+
+	var l tlsaParamsList
+	assert.NoError(t, l.Set("3 1 1"), "Expected no error")
+	assert.NoError(t, l.Set("2 0 2"), "Expected no error")
+	assert.ErrorContains(t, l.Set(" 3 1 1"), "given twice", "Expected repeated tuple to be refused")
+	assert.Equal(t, "3 1 1,2 0 2", l.String(), "Expected list to be printed")
 }
 
 const caPem = `-----BEGIN CERTIFICATE-----
@@ -101,14 +148,14 @@ func TestReadCerts(t *testing.T) {
 
 			assert.NoError(t, err, "Expected no error")
 			if tt.trustAnchor {
-				assert.NotEmpty(t, tlsa.TrustAnchor, "Expected TrustAnchor to be non-nil")
+				assert.NotEmpty(t, tlsa.Records[1].Data, "Expected TrustAnchor to be non-nil")
 			} else {
-				assert.Empty(t, tlsa.TrustAnchor, "Expected TrustAnchor to be empty")
+				assert.Empty(t, tlsa.Records[1].Data, "Expected TrustAnchor to be empty")
 			}
 			if tt.endEntity {
-				assert.NotEmpty(t, tlsa.EndEntity, "Expected EndEntity to be non-nil")
+				assert.NotEmpty(t, tlsa.Records[0].Data, "Expected EndEntity to be non-nil")
 			} else {
-				assert.Empty(t, tlsa.EndEntity, "Expected EndEntity to be empty")
+				assert.Empty(t, tlsa.Records[0].Data, "Expected EndEntity to be empty")
 			}
 			if tt.dnsNames {
 				assert.NotEmpty(t, tlsa.DNSNames, "Expected DNSNames to be non-nil")
@@ -118,46 +165,69 @@ func TestReadCerts(t *testing.T) {
 		})
 	}
 }
+
+func TestReadCertParams(t *testing.T) {
+	ca, _ := tls.X509KeyPair([]byte(caPem), []byte(caKey))
+	leaf, _ := tls.X509KeyPair([]byte(certPem), []byte(certKey))
+
+	tlsa := NewTLSA(tlsaParams{3, 0, 1}, tlsaParams{3, 1, 0}, tlsaParams{2, 0, 2}, tlsaParams{3, 0, 1})
+	assert.NoError(t, tlsa.ReadCert(leaf.Leaf), "Expected no error")
+	assert.NoError(t, tlsa.ReadCert(ca.Leaf), "Expected no error")
+
+	want := func(selector, matchingType uint8, c *x509.Certificate) string {
+		d, err := dns.CertificateToDANE(selector, matchingType, c)
+		assert.NoError(t, err, "Expected no error")
+		return d
+	}
+	assert.Equal(t, []string{
+		"3 0 1 " + want(0, 1, leaf.Leaf),
+		"3 1 0 " + hex.EncodeToString(leaf.Leaf.RawSubjectPublicKeyInfo),
+		"2 0 2 " + want(0, 2, ca.Leaf),
+	}, tlsa.MakeRRData(), "Expected one record per configured tuple")
+	assert.Len(t, tlsa.Records[2].Data, 128, "Expected SHA-512 digest")
+}
+
+func TestReadCertPKIX(t *testing.T) {
+	ca, _ := tls.X509KeyPair([]byte(caPem), []byte(caKey))
+	leaf, _ := tls.X509KeyPair([]byte(certPem), []byte(certKey))
+
+	tlsa := NewTLSA(tlsaParams{1, 1, 1}, tlsaParams{0, 1, 1}, tlsaParams{3, 1, 1}, tlsaParams{2, 1, 1})
+	assert.NoError(t, tlsa.ReadCert(leaf.Leaf), "Expected no error")
+	assert.NoError(t, tlsa.ReadCert(ca.Leaf), "Expected no error")
+
+	assert.Equal(t, tlsa.Records[2].Data, tlsa.Records[0].Data, "Expected PKIX-EE to match the leaf like DANE-EE")
+	assert.Equal(t, tlsa.Records[3].Data, tlsa.Records[1].Data, "Expected PKIX-TA to match the CA like DANE-TA")
+	assert.NotEqual(t, tlsa.Records[0].Data, tlsa.Records[1].Data, "Expected different certificates")
+}
+
 func TestMakeRRData(t *testing.T) {
 	tests := []struct {
 		name        string
-		tlsa        tlsa
+		tlsa        *tlsa
 		expectedRRs []string
 	}{
 		{
-			name: "EmptyTLSA",
-			tlsa: tlsa{},
-			expectedRRs: []string{
-				"3 1 1 ",
-				"2 1 1 ",
-			},
+			name:        "EmptyTLSA",
+			tlsa:        testTLSA("", ""),
+			expectedRRs: []string{},
 		},
 		{
 			name: "EndEntityOnly",
-			tlsa: tlsa{
-				EndEntity: "abcdef123456",
-			},
+			tlsa: testTLSA("abcdef123456", ""),
 			expectedRRs: []string{
 				"3 1 1 abcdef123456",
-				"2 1 1 ",
 			},
 		},
 		{
 			name: "TrustAnchorOnly",
-			tlsa: tlsa{
-				TrustAnchor: "123456abcdef",
-			},
+			tlsa: testTLSA("", "123456abcdef"),
 			expectedRRs: []string{
-				"3 1 1 ",
 				"2 1 1 123456abcdef",
 			},
 		},
 		{
 			name: "BothEndEntityAndTrustAnchor",
-			tlsa: tlsa{
-				EndEntity:   "abcdef123456",
-				TrustAnchor: "123456abcdef",
-			},
+			tlsa: testTLSA("abcdef123456", "123456abcdef"),
 			expectedRRs: []string{
 				"3 1 1 abcdef123456",
 				"2 1 1 123456abcdef",
@@ -172,3 +242,281 @@ func TestMakeRRData(t *testing.T) {
 		})
 	}
 }
+
+func TestTLSACheck(t *testing.T) {
+	assert.NoError(t, testTLSA("abcdef", "123456").Check(), "Expected no error")
+	assert.EqualError(t, testTLSA("abcdef", "").Check(),
+		"cannot derive TLSA records 2 1 1 (no CA certificate selected)",
+		"Expected missing trust anchor to be reported")
+	assert.EqualError(t, testTLSA("", "").Check(),
+		"cannot derive TLSA records 3 1 1 (no end entity certificate), 2 1 1 (no CA certificate selected)",
+		"Expected both records to be reported")
+}
+
+func TestNewChange(t *testing.T) {
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.", "www.example.com.")
+	existing := []*rrset{
+		{
+			Name:    "_25._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 000000"},
+		},
+		{
+			Name:    "_443._tcp.www.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 000000"},
+		},
+		{
+			Name:    "_443._tcp.other.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 000000"},
+		},
+		{
+			Name:    "com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 000000"},
+		},
+	}
+
+	cset, unmanaged := newChange(existing, d, changeOptions{})
+
+	assert.Equal(t, []*rrset{existing[1]}, cset.Deletions, "Expected configured RRset to be replaced")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: d.MakeRRData(),
+		},
+		{
+			Name:    "_443._tcp.www.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: d.MakeRRData(),
+		},
+	}, cset.Additions, "Expected RRsets to be added")
+	assert.Equal(t, []*rrset{existing[0], existing[3]}, unmanaged, "Expected other RRsets to be reported")
+}
+
+func TestNewChangeUnchanged(t *testing.T) {
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.")
+	existing := []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"2 1 1 123456ABCDEF", "3 1 1 abcdef123456"},
+		},
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TXT",
+			TTL:     3600,
+			Rrdatas: []string{`"cdh lineage=example.com tlsa=3-1-1:abcdef123456 added=2023-01-01T00:00:00Z"`},
+		},
+	}
+
+	cset, _ := newChange(existing, d, changeOptions{})
+	assert.True(t, cset.Empty(), "Expected RRset with the same records to be left alone")
+
+	cset, _ = newChange(existing, d, changeOptions{Registry: true, Lineage: "example.com"})
+	assert.Equal(t, existing[1:], cset.Deletions, "Expected only the registry to change")
+}
+
+func TestNewChangeServices(t *testing.T) {
+	var services serviceMap
+	assert.NoError(t, services.Set("mail.example.com=25/tcp,465/tcp"), "Expected no error")
+	assert.NoError(t, services.Set(".xmpp.example.com=5222/tcp,5269"), "Expected no error")
+	assert.NoError(t, services.Set("quic*.example.com=443/udp,443/tcp"), "Expected no error")
+
+	d := testTLSA("abcdef123456", "123456abcdef",
+		"mail.example.com.", "chat.xmpp.example.com.", "quic1.example.com.", "www.example.com.")
+
+	pinned := &rrset{
+		Name:    "_993._tcp.mail.example.com.",
+		Type:    "TLSA",
+		TTL:     3600,
+		Rrdatas: []string{"3 1 1 000000"},
+	}
+
+	cset, unmanaged := newChange([]*rrset{pinned}, d, changeOptions{Services: services})
+
+	var names []string
+	for _, r := range cset.Additions {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{
+		"_25._tcp.mail.example.com.",
+		"_465._tcp.mail.example.com.",
+		"_5222._tcp.chat.xmpp.example.com.",
+		"_5269._tcp.chat.xmpp.example.com.",
+		"_443._udp.quic1.example.com.",
+		"_443._tcp.quic1.example.com.",
+		"_443._tcp.www.example.com.",
+	}, names, "Expected one RRset per mapped service")
+	assert.Empty(t, cset.Deletions, "Expected nothing to delete")
+	assert.Equal(t, []*rrset{pinned}, unmanaged, "Expected hand-maintained RRset to be left alone")
+}
+
+func TestNewChangeMerge(t *testing.T) {
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.")
+	d.Previous = []tlsaRecord{{tlsaParams{3, 1, 1}, "000000"}, {tlsaParams{3, 1, 1}, testPin}}
+	existing := []*rrset{{
+		Name:    "_443._tcp.example.com.",
+		Type:    "TLSA",
+		TTL:     3600,
+		Rrdatas: []string{"3 1 1 000000", "3 1 1 " + testPin, "3 1 1 222222", "3 0 1 111111"},
+	}}
+
+	cset, _ := newChange(existing, d, changeOptions{})
+	assert.Equal(t, d.MakeRRData(), cset.Additions[0].Rrdatas, "Expected records to be replaced")
+
+	cset, _ = newChange(existing, d, changeOptions{Merge: true})
+	assert.Equal(t, []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef", "3 1 1 222222", "3 0 1 111111"},
+		cset.Additions[0].Rrdatas, "Expected foreign records to be kept")
+
+	cset, _ = newChange(existing, d, changeOptions{Pins: pinList{testPin}})
+	assert.Equal(t, []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef", "3 1 1 " + testPin, "3 1 1 222222", "3 0 1 111111"},
+		cset.Additions[0].Rrdatas, "Expected pinned key to be kept")
+	assert.Equal(t, existing, cset.Deletions, "Expected existing RRset to be replaced")
+}
+
+func TestNewChangeRegistry(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.", "www.example.com.")
+	existing := []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 000000", "3 1 1 111111"},
+		},
+		{
+			Name:    "cdh-_443._tcp.example.com.",
+			Type:    "TXT",
+			TTL:     3600,
+			Rrdatas: []string{`"cdh lineage=example.com tlsa=3-1-1:000000 added=2023-01-01T00:00:00Z"`},
+		},
+	}
+
+	cset, _ := newChange(existing, d, changeOptions{
+		Registry:       true,
+		RegistryPrefix: "cdh-",
+		Lineage:        "example.com",
+		Now:            now,
+	})
+
+	assert.Equal(t, existing, cset.Deletions, "Expected RRset and registry to be replaced")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef", "3 1 1 111111"},
+		},
+		{
+			Name: "cdh-_443._tcp.example.com.",
+			Type: "TXT",
+			TTL:  3600,
+			Rrdatas: []string{
+				`"cdh lineage=example.com tlsa=3-1-1:abcdef123456 added=2024-01-02T03:04:05Z"`,
+				`"cdh lineage=example.com tlsa=2-1-1:123456abcdef added=2024-01-02T03:04:05Z"`,
+			},
+		},
+		{
+			Name:    "_443._tcp.www.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: d.MakeRRData(),
+		},
+		{
+			Name: "cdh-_443._tcp.www.example.com.",
+			Type: "TXT",
+			TTL:  300,
+			Rrdatas: []string{
+				`"cdh lineage=example.com tlsa=3-1-1:abcdef123456 added=2024-01-02T03:04:05Z"`,
+				`"cdh lineage=example.com tlsa=2-1-1:123456abcdef added=2024-01-02T03:04:05Z"`,
+			},
+		},
+	}, cset.Additions, "Expected the record added by hand to be kept")
+}
+
+func TestNewChangeLineages(t *testing.T) {
+	then := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := then.Add(60 * 24 * time.Hour)
+	entry := func(lineage, record string, added time.Time) string {
+		return `"` + registryEntry{lineage, record, added}.String() + `"`
+	}
+
+	existing := []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 aaaa", "3 1 1 bbbb", "2 1 1 cccc"},
+		},
+		{
+			Name: "_443._tcp.example.com.",
+			Type: "TXT",
+			TTL:  3600,
+			Rrdatas: []string{
+				entry("rsa", "3-1-1:aaaa", then),
+				entry("rsa", "2-1-1:cccc", then),
+				entry("ecdsa", "3-1-1:bbbb", then),
+				entry("ecdsa", "2-1-1:cccc", then),
+			},
+		},
+		{
+			Name:    "_443._tcp.old.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 bbbb", "3 1 1 dddd"},
+		},
+		{
+			Name:    "_443._tcp.old.example.com.",
+			Type:    "TXT",
+			TTL:     3600,
+			Rrdatas: []string{entry("ecdsa", "3-1-1:bbbb", then)},
+		},
+		{
+			Name:    "example.com.",
+			Type:    "TXT",
+			TTL:     3600,
+			Rrdatas: []string{`"v=spf1 -all"`},
+		},
+	}
+
+	// The ECDSA lineage renews and no longer covers old.example.com.
+	d := testTLSA("eeee", "cccc", "example.com.")
+	cset, _ := newChange(existing, d, changeOptions{Registry: true, Lineage: "ecdsa", Now: now})
+
+	assert.Equal(t, existing[:4], cset.Deletions, "Expected RRsets of the lineage to be changed")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 eeee", "2 1 1 cccc", "3 1 1 aaaa"},
+		},
+		{
+			Name: "_443._tcp.example.com.",
+			Type: "TXT",
+			TTL:  3600,
+			Rrdatas: []string{
+				entry("ecdsa", "3-1-1:eeee", now),
+				entry("ecdsa", "2-1-1:cccc", then),
+				entry("rsa", "3-1-1:aaaa", then),
+				entry("rsa", "2-1-1:cccc", then),
+			},
+		},
+		{
+			Name:    "_443._tcp.old.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 dddd"},
+		},
+	}, cset.Additions, "Expected the union of the lineages")
+}
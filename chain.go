@@ -0,0 +1,255 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// taPolicy selects the CA certificates of a chain that are published as
+// trust anchors.
+type taPolicy struct {
+	Kind  string
+	Value string
+}
+
+// taPolicyKinds lists the accepted policies and whether they take a value.
+var taPolicyKinds = map[string]bool{
+	"issuer":  false,
+	"top":     false,
+	"all":     false,
+	"subject": true,
+	"spki":    true,
+}
+
+// String returns the policy as given on the command line.
+func (p *taPolicy) String() string {
+	if p.Value != "" {
+		return p.Kind + "=" + p.Value
+	}
+	return p.Kind
+}
+
+// Set parses a policy such as "issuer" or "spki=<hex>".
+func (p *taPolicy) Set(v string) error {
+	kind, value, _ := strings.Cut(v, "=")
+	hasValue, ok := taPolicyKinds[kind]
+	if !ok {
+		return fmt.Errorf("unknown trust anchor policy %q", kind)
+	}
+	if hasValue != (value != "") {
+		if hasValue {
+			return fmt.Errorf("trust anchor policy %s needs a value", kind)
+		}
+		return fmt.Errorf("trust anchor policy %s takes no value", kind)
+	}
+
+	p.Kind, p.Value = kind, value
+	return nil
+}
+
+// spkiHash returns the hex encoded SHA-256 digest of the public key of c.
+func spkiHash(c *x509.Certificate) string {
+	h := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:])
+}
+
+// Select returns the CA certificates of chain chosen by the policy. The
+// chain starts with the leaf and is ordered by signature.
+func (p taPolicy) Select(chain []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(chain) < 2 {
+		return nil, nil
+	}
+	cas := chain[1:]
+
+	switch p.Kind {
+	case "", "issuer":
+		return cas[:1], nil
+	case "top":
+		return cas[len(cas)-1:], nil
+	case "all":
+		return cas, nil
+	}
+
+	for _, c := range cas {
+		switch {
+		case p.Kind == "subject" && (c.Subject.String() == p.Value || c.Subject.CommonName == p.Value):
+			return []*x509.Certificate{c}, nil
+		case p.Kind == "spki" && strings.EqualFold(spkiHash(c), p.Value):
+			return []*x509.Certificate{c}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no CA certificate in the chain matches %s", p.String())
+}
+
+// buildChain orders certs from the first end entity certificate up through
+// its issuers, checking each link with CheckSignatureFrom. Certificates that
+// are not part of the chain are returned separately.
+func buildChain(certs []*x509.Certificate) (chain, rest []*x509.Certificate) {
+	used := make([]bool, len(certs))
+
+	for i, c := range certs {
+		if !c.IsCA {
+			chain = append(chain, c)
+			used[i] = true
+			break
+		}
+	}
+
+	for len(chain) > 0 {
+		cur := chain[len(chain)-1]
+		next := -1
+		for i, c := range certs {
+			if !used[i] && c.IsCA && cur.CheckSignatureFrom(c) == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		used[next] = true
+		chain = append(chain, certs[next])
+	}
+
+	for i, c := range certs {
+		if !used[i] {
+			rest = append(rest, c)
+		}
+	}
+
+	return chain, rest
+}
+
+// readSiblings reads the CA certificates from the PEM files in dir that are
+// still valid at now. These are the other intermediates a CA may issue from,
+// published as trust anchors alongside the one in the chain.
+func readSiblings(dir string, now time.Time) ([]*x509.Certificate, error) {
+	files, err := filepath.Glob(filepath.Join(filepath.Clean(dir), "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, f := range files {
+		cs, err := readSiblingFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			if !c.NotAfter.Before(now) {
+				certs = append(certs, c)
+			}
+		}
+	}
+
+	return certs, nil
+}
+
+// readSiblingFile reads the CA certificates from the PEM file f.
+func readSiblingFile(f string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for b, r := pem.Decode(data); b != nil; b, r = pem.Decode(r) {
+		if b.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(b.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		if !c.IsCA {
+			return nil, fmt.Errorf("%s: %s is not a CA certificate", f, c.Subject)
+		}
+		certs = append(certs, c)
+	}
+
+	return certs, nil
+}
+
+// containsCert reports whether certs holds c.
+func containsCert(certs []*x509.Certificate, c *x509.Certificate) bool {
+	for _, o := range certs {
+		if bytes.Equal(o.Raw, c.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSiblings saves the certificates of tas that are not among siblings to
+// dir, so the set follows the CA as it rotates intermediates, and removes the
+// files whose certificates have all expired at now.
+func saveSiblings(dir string, siblings, tas []*x509.Certificate, now time.Time) error {
+	files, err := filepath.Glob(filepath.Join(filepath.Clean(dir), "*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		cs, err := readSiblingFile(f)
+		if err != nil {
+			return err
+		}
+		live := false
+		for _, c := range cs {
+			live = live || !c.NotAfter.Before(now)
+		}
+		if len(cs) > 0 && !live {
+			if err = os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range tas {
+		if containsCert(siblings, c) {
+			continue
+		}
+		h := sha256.Sum256(c.Raw)
+		f := filepath.Join(filepath.Clean(dir), hex.EncodeToString(h[:8])+".pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		if err := os.WriteFile(f, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSiblings returns tas followed by the siblings not among them.
+func addSiblings(siblings, tas []*x509.Certificate) []*x509.Certificate {
+	all := append([]*x509.Certificate(nil), tas...)
+	for _, c := range siblings {
+		if !containsCert(tas, c) {
+			all = append(all, c)
+		}
+	}
+	return all
+}
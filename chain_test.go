@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA is a certificate with its key for signing test chains.
+type testCA struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for name signed by parent, or a
+// self-signed one if parent is nil. The key is reused if given.
+func newTestCert(t *testing.T, name string, ca bool, parent *testCA, key *ecdsa.PrivateKey) *testCA {
+	if key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err, "Expected no error")
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err, "Expected no error")
+	c, err := x509.ParseCertificate(der)
+	assert.NoError(t, err, "Expected no error")
+
+	return &testCA{Cert: c, Key: key}
+}
+
+// writeFullchain writes certs as fullchain.pem to a new lineage directory.
+func writeFullchain(t *testing.T, certs ...*x509.Certificate) string {
+	dir := t.TempDir()
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "fullchain.pem"), data, 0o644), "Expected no error")
+	return dir
+}
+
+// testChain is a cross-signed chain: leaf <- intermediate <- root, where
+// root is also cross-signed by an old root.
+type testChain struct {
+	OldRoot, Root, Cross, Inter, Leaf *testCA
+}
+
+func newTestChain(t *testing.T) *testChain {
+	c := &testChain{}
+	c.OldRoot = newTestCert(t, "Old Root", true, nil, nil)
+	c.Root = newTestCert(t, "Root", true, nil, nil)
+	c.Cross = newTestCert(t, "Root", true, c.OldRoot, c.Root.Key)
+	c.Inter = newTestCert(t, "Intermediate", true, c.Root, nil)
+	c.Leaf = newTestCert(t, "example.com", false, c.Inter, nil)
+	return c
+}
+
+func TestBuildChain(t *testing.T) {
+	c := newTestChain(t)
+	stray := newTestCert(t, "Stray", true, nil, nil)
+
+	chain, rest := buildChain([]*x509.Certificate{c.Cross.Cert, stray.Cert, c.Inter.Cert, c.Leaf.Cert})
+
+	assert.Equal(t, []*x509.Certificate{c.Leaf.Cert, c.Inter.Cert, c.Cross.Cert}, chain, "Expected chain in signature order")
+	assert.Equal(t, []*x509.Certificate{stray.Cert}, rest, "Expected unrelated CA to be left out")
+}
+
+func TestTAPolicySelect(t *testing.T) {
+	c := newTestChain(t)
+	chain := []*x509.Certificate{c.Leaf.Cert, c.Inter.Cert, c.Cross.Cert}
+
+	for policy, want := range map[string][]*x509.Certificate{
+		"issuer":                         {c.Inter.Cert},
+		"top":                            {c.Cross.Cert},
+		"all":                            {c.Inter.Cert, c.Cross.Cert},
+		"subject=Root":                   {c.Cross.Cert},
+		"subject=CN=Intermediate":        {c.Inter.Cert},
+		"spki=" + spkiHash(c.Cross.Cert): {c.Cross.Cert},
+	} {
+		var p taPolicy
+		assert.NoError(t, p.Set(policy), "Expected no error")
+		assert.Equal(t, policy, p.String(), "Expected policy to be printed")
+
+		got, err := p.Select(chain)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, want, got, "Expected %s to select", policy)
+	}
+
+	var p taPolicy
+	assert.NoError(t, p.Set("subject=Nobody"), "Expected no error")
+	_, err := p.Select(chain)
+	assert.ErrorContains(t, err, "subject=Nobody", "Expected missing subject to be refused")
+
+	for _, v := range []string{"first", "subject", "issuer=x"} {
+		assert.Error(t, p.Set(v), "Expected %q to be refused", v)
+	}
+}
+
+func TestReadCertPolicy(t *testing.T) {
+	c := newTestChain(t)
+	// The root comes before the intermediate in the file.
+	dir := writeFullchain(t, c.Leaf.Cert, c.Cross.Cert, c.Inter.Cert)
+
+	d, err := readCert(dir, certOptions{})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, testTLSA(spkiHash(c.Leaf.Cert), spkiHash(c.Inter.Cert), "example.com.").Records, d.Records, "Expected issuing intermediate")
+
+	d, err = readCert(dir, certOptions{Policy: taPolicy{Kind: "all"}})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{
+		"3 1 1 " + spkiHash(c.Leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+		"2 1 1 " + spkiHash(c.Cross.Cert),
+	}, d.MakeRRData(), "Expected every CA in the chain")
+}
+
+func TestReadCertSiblings(t *testing.T) {
+	c := newTestChain(t)
+	sibling := newTestCert(t, "Sibling", true, c.Root, nil)
+	dir := writeFullchain(t, c.Leaf.Cert, c.Inter.Cert)
+
+	siblings := t.TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sibling.Cert.Raw})
+	assert.NoError(t, os.WriteFile(filepath.Join(siblings, "sibling.pem"), data, 0o644), "Expected no error")
+
+	d, err := readCert(dir, certOptions{Siblings: siblings})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{
+		"3 1 1 " + spkiHash(c.Leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+		"2 1 1 " + spkiHash(sibling.Cert),
+	}, d.MakeRRData(), "Expected siblings next to the issuer")
+
+	got, err := readSiblings(siblings, time.Time{})
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, got, 1, "Expected the directory to be left alone")
+
+	_, err = readCert(dir, certOptions{Siblings: siblings, SaveSiblings: true})
+	assert.NoError(t, err, "Expected no error")
+	got, err = readSiblings(siblings, time.Time{})
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, got, 2, "Expected new intermediate to join the siblings")
+
+	// A renewal from the sibling publishes the same set.
+	leaf := newTestCert(t, "example.com", false, sibling, nil)
+	d, err = readCert(writeFullchain(t, leaf.Cert, sibling.Cert), certOptions{Siblings: siblings})
+	assert.NoError(t, err, "Expected no error")
+	assert.ElementsMatch(t, []string{
+		"3 1 1 " + spkiHash(leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+		"2 1 1 " + spkiHash(sibling.Cert),
+	}, d.MakeRRData(), "Expected the same trust anchors after the switch")
+}
+
+func TestReadCertExpiredSibling(t *testing.T) {
+	c := newTestChain(t)
+	dir := writeFullchain(t, c.Leaf.Cert, c.Inter.Cert)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Expired"},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              time.Now().Add(-time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.Root.Cert, &c.Root.Key.PublicKey, c.Root.Key)
+	assert.NoError(t, err, "Expected no error")
+
+	siblings := t.TempDir()
+	expired := filepath.Join(siblings, "expired.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, os.WriteFile(expired, data, 0o644), "Expected no error")
+
+	d, err := readCert(dir, certOptions{Siblings: siblings, Now: time.Now()})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{
+		"3 1 1 " + spkiHash(c.Leaf.Cert),
+		"2 1 1 " + spkiHash(c.Inter.Cert),
+	}, d.MakeRRData(), "Expected expired sibling to be left out")
+	assert.FileExists(t, expired, "Expected the directory to be left alone")
+
+	_, err = readCert(dir, certOptions{Siblings: siblings, SaveSiblings: true, Now: time.Now()})
+	assert.NoError(t, err, "Expected no error")
+	assert.NoFileExists(t, expired, "Expected expired sibling to be removed")
+	got, err := readSiblings(siblings, time.Now())
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, got, 1, "Expected only the intermediate to be saved")
+}
+
+func TestReadSiblingsLeaf(t *testing.T) {
+	c := newTestChain(t)
+	dir := t.TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Leaf.Cert.Raw})
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "leaf.pem"), data, 0o644), "Expected no error")
+
+	_, err := readSiblings(dir, time.Time{})
+
+	assert.ErrorContains(t, err, "not a CA certificate", "Expected leaf to be refused")
+}
+
+func TestReadCertMissingCA(t *testing.T) {
+	c := newTestChain(t)
+	dir := writeFullchain(t, c.Leaf.Cert)
+
+	_, err := readCert(dir, certOptions{})
+	assert.ErrorContains(t, err, "2 1 1 (no CA certificate selected)", "Expected missing DANE-TA to be refused")
+
+	d, err := readCert(dir, certOptions{Params: tlsaParamsList{{3, 1, 1}}})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{"3 1 1 " + spkiHash(c.Leaf.Cert)}, d.MakeRRData(), "Expected DANE-EE only")
+}
@@ -0,0 +1,425 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// cloudflareEndpoint is the default base URL of the Cloudflare v4 API.
+const cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+// cloudflareTLSA is the structured form of TLSA rdata used by Cloudflare.
+type cloudflareTLSA struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"`
+}
+
+// cloudflareRecord is a single DNS record in the Cloudflare API. TLSA
+// records carry structured data, TXT records their text as content.
+type cloudflareRecord struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Name    string          `json:"name"`
+	TTL     int64           `json:"ttl"`
+	Content string          `json:"content,omitempty"`
+	Data    *cloudflareTLSA `json:"data,omitempty"`
+}
+
+// newCloudflareRecord converts one record of r from presentation format.
+func newCloudflareRecord(r *rrset, rdata string) (*cloudflareRecord, error) {
+	rec := &cloudflareRecord{
+		Type: r.Type,
+		Name: strings.TrimSuffix(r.Name, "."),
+		TTL:  r.TTL,
+	}
+
+	if strings.EqualFold(r.Type, "TXT") {
+		rr, err := dns.NewRR(". TXT " + rdata)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range rr.(*dns.TXT).Txt {
+			rec.Content += unescapeTXT(t)
+		}
+		return rec, nil
+	}
+
+	data, err := toCloudflareTLSA(rdata)
+	if err != nil {
+		return nil, err
+	}
+	rec.Data = data
+	return rec, nil
+}
+
+// unescapeTXT resolves the \X and \DDD escapes miekg/dns keeps in the
+// strings of a TXT record.
+func unescapeTXT(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i+3 <= len(s) {
+			if n, err := strconv.ParseUint(s[i:i+3], 10, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Rdata returns the record data in presentation format, or an empty string
+// if the record has none.
+func (r *cloudflareRecord) Rdata() string {
+	switch {
+	case r.Type == "TXT":
+		rr := &dns.TXT{Hdr: dns.RR_Header{Rrtype: dns.TypeTXT}, Txt: []string{r.Content}}
+		return strings.TrimPrefix(rr.String(), rr.Hdr.String())
+	case r.Data != nil:
+		return r.Data.String()
+	}
+	return ""
+}
+
+// cloudflareResponse is the envelope of every Cloudflare API response.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// toCloudflareTLSA converts presentation format TLSA rdata such as
+// "3 1 1 abcdef" to its structured form.
+func toCloudflareTLSA(rdata string) (*cloudflareTLSA, error) {
+	rr, err := dns.NewRR(". TLSA " + rdata)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := rr.(*dns.TLSA)
+	if !ok {
+		return nil, fmt.Errorf("not TLSA rdata: %s", rdata)
+	}
+
+	return &cloudflareTLSA{
+		Usage:        t.Usage,
+		Selector:     t.Selector,
+		MatchingType: t.MatchingType,
+		Certificate:  strings.ToLower(t.Certificate),
+	}, nil
+}
+
+// String returns the rdata in presentation format.
+func (t *cloudflareTLSA) String() string {
+	return fmt.Sprintf("%d %d %d %s", t.Usage, t.Selector, t.MatchingType, strings.ToLower(t.Certificate))
+}
+
+// cloudflareProvider manages TLSA and registry TXT records in a Cloudflare
+// zone.
+type cloudflareProvider struct {
+	endpoint string
+	token    string
+	client   *http.Client
+	zoneID   string
+}
+
+// newCloudflareProvider creates a Cloudflare provider. The key file holds a
+// scoped API token; without it CLOUDFLARE_API_TOKEN is used. The zone ID is
+// looked up by the name of the zone.
+func newCloudflareProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(filepath.Clean(cfg.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("cloudflare: no API token")
+	}
+
+	endpoint := cfg.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = cloudflareEndpoint
+	}
+
+	p := &cloudflareProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		client:   http.DefaultClient,
+		zoneID:   cfg.Options["zone-id"],
+	}
+
+	if p.zoneID == "" {
+		var err error
+		if p.zoneID, err = p.findZone(ctx, strings.TrimSuffix(cfg.Zone, ".")); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// do sends an authenticated request to the Cloudflare API and decodes the
+// result into out.
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, query url.Values, in, out any) (*cloudflareResponse, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := p.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("cloudflare: %s %s: %s", method, path, resp.Status)
+	}
+
+	if !r.Success || resp.StatusCode/100 != 2 {
+		msgs := make([]string, 0, len(r.Errors))
+		for _, e := range r.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		if len(msgs) == 0 {
+			msgs = append(msgs, resp.Status)
+		}
+		return nil, fmt.Errorf("cloudflare: %s %s: %s", method, path, strings.Join(msgs, "; "))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(r.Result, out); err != nil {
+			return nil, err
+		}
+	}
+
+	return &r, nil
+}
+
+// findZone returns the ID of the zone named zone.
+func (p *cloudflareProvider) findZone(ctx context.Context, zone string) (string, error) {
+	var zones []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if _, err := p.do(ctx, http.MethodGet, "/zones", url.Values{"name": {zone}}, nil, &zones); err != nil {
+		return "", err
+	}
+
+	for _, z := range zones {
+		if strings.EqualFold(z.Name, zone) {
+			return z.ID, nil
+		}
+	}
+
+	return "", fmt.Errorf("cloudflare: no zone named %s", zone)
+}
+
+// records returns all records of the managed types in the zone, following
+// pagination.
+func (p *cloudflareProvider) records(ctx context.Context) ([]cloudflareRecord, error) {
+	var all []cloudflareRecord
+
+	for _, t := range managedTypes {
+		for page := 1; ; page++ {
+			var recs []cloudflareRecord
+			r, err := p.do(ctx, http.MethodGet, "/zones/"+p.zoneID+"/dns_records", url.Values{
+				"type":     {t},
+				"page":     {strconv.Itoa(page)},
+				"per_page": {"100"},
+			}, nil, &recs)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, recs...)
+
+			if page >= r.ResultInfo.TotalPages {
+				break
+			}
+		}
+	}
+
+	return all, nil
+}
+
+// List returns the records of the managed types in the zone grouped into
+// RRsets.
+func (p *cloudflareProvider) List(ctx context.Context) ([]*rrset, error) {
+	recs, err := p.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rr []*rrset
+	index := make(map[string]*rrset)
+	for _, r := range recs {
+		d := r.Rdata()
+		if d == "" {
+			continue
+		}
+		name := dns.Fqdn(r.Name)
+		k := rrsetKey(name, r.Type)
+		s, ok := index[k]
+		if !ok {
+			s = &rrset{Name: name, Type: r.Type, TTL: r.TTL}
+			index[k] = s
+			rr = append(rr, s)
+		}
+		s.Rrdatas = append(s.Rrdatas, d)
+	}
+
+	return rr, nil
+}
+
+// Apply brings the records of every RRset in the changeset to their new
+// rdata. Records that stay are left alone, changed records are updated in
+// place and the rest are created or deleted. Cloudflare applies changes
+// immediately, so the returned ID is empty.
+func (p *cloudflareProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	recs, err := p.records(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	current := make(map[string][]cloudflareRecord)
+	for _, r := range recs {
+		k := rrsetKey(dns.Fqdn(r.Name), r.Type)
+		current[k] = append(current[k], r)
+	}
+
+	var keys []string
+	want := make(map[string]*rrset)
+	for _, r := range c.Deletions {
+		k := keyOf(r)
+		if _, ok := want[k]; !ok {
+			keys = append(keys, k)
+			want[k] = nil
+		}
+	}
+	for _, r := range c.Additions {
+		k := keyOf(r)
+		if _, ok := want[k]; !ok {
+			keys = append(keys, k)
+		}
+		want[k] = r
+	}
+
+	path := "/zones/" + p.zoneID + "/dns_records"
+	for _, k := range keys {
+		var stale []cloudflareRecord
+		keep := make(map[string]bool)
+		var add []*cloudflareRecord
+
+		if r := want[k]; r != nil {
+			for _, d := range r.Rrdatas {
+				rec, err := newCloudflareRecord(r, d)
+				if err != nil {
+					return "", err
+				}
+				keep[rec.Rdata()] = false
+				add = append(add, rec)
+			}
+		}
+
+		for _, old := range current[k] {
+			if seen, ok := keep[old.Rdata()]; ok && !seen {
+				keep[old.Rdata()] = true
+				continue
+			}
+			stale = append(stale, old)
+		}
+
+		for _, rec := range add {
+			if keep[rec.Rdata()] {
+				continue
+			}
+			if len(stale) > 0 {
+				id := stale[0].ID
+				stale = stale[1:]
+				if _, err := p.do(ctx, http.MethodPut, path+"/"+id, nil, rec, nil); err != nil {
+					return "", err
+				}
+				continue
+			}
+			if _, err := p.do(ctx, http.MethodPost, path, nil, rec, nil); err != nil {
+				return "", err
+			}
+		}
+
+		for _, old := range stale {
+			if _, err := p.do(ctx, http.MethodDelete, path+"/"+old.ID, nil, nil, nil); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// Wait returns immediately as Cloudflare applies changes synchronously.
+func (p *cloudflareProvider) Wait(ctx context.Context, id string) error {
+	return nil
+}
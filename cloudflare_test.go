@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCloudflare is a minimal stand-in for the Cloudflare v4 API.
+type testCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cloudflareRecord
+	next    int
+	calls   []string
+}
+
+func (c *testCloudflare) reply(w http.ResponseWriter, result any, pages int) {
+	data, _ := json.Marshal(result)
+	r := cloudflareResponse{Success: true, Result: data}
+	r.ResultInfo.TotalPages = pages
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+func (c *testCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/zones")
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		c.reply(w, []map[string]string{{"id": "zone1", "name": r.URL.Query().Get("name")}}, 1)
+	case r.Method == http.MethodGet && path == "/zone1/dns_records":
+		var recs []cloudflareRecord
+		for i := 1; i <= c.next; i++ {
+			if rec, ok := c.records[strconv.Itoa(i)]; ok && rec.Type == r.URL.Query().Get("type") {
+				recs = append(recs, rec)
+			}
+		}
+		// Serve one record per page to exercise pagination.
+		pages := len(recs)
+		i, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		i--
+		if i < len(recs) {
+			recs = recs[i : i+1]
+		} else {
+			recs = nil
+		}
+		c.reply(w, recs, pages)
+	case r.Method == http.MethodPost && path == "/zone1/dns_records":
+		var rec cloudflareRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		c.next++
+		rec.ID = strconv.Itoa(c.next)
+		c.records[rec.ID] = rec
+		c.calls = append(c.calls, "POST "+rec.Rdata())
+		c.reply(w, rec, 1)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/zone1/dns_records/"):
+		var rec cloudflareRecord
+		_ = json.NewDecoder(r.Body).Decode(&rec)
+		rec.ID = strings.TrimPrefix(path, "/zone1/dns_records/")
+		c.records[rec.ID] = rec
+		c.calls = append(c.calls, "PUT "+rec.ID+" "+rec.Rdata())
+		c.reply(w, rec, 1)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/zone1/dns_records/"):
+		id := strings.TrimPrefix(path, "/zone1/dns_records/")
+		delete(c.records, id)
+		c.calls = append(c.calls, "DELETE "+id)
+		c.reply(w, map[string]string{"id": id}, 1)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestCloudflare(t *testing.T, recs ...cloudflareRecord) (*testCloudflare, provider) {
+	cf := &testCloudflare{records: make(map[string]cloudflareRecord)}
+	for _, rec := range recs {
+		cf.next++
+		rec.ID = strconv.Itoa(cf.next)
+		cf.records[rec.ID] = rec
+	}
+	srv := httptest.NewServer(cf)
+	t.Cleanup(srv.Close)
+
+	key := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(key, []byte("test-token\n"), 0o600), "Expected no error")
+
+	p, err := newCloudflareProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		KeyFile: key,
+		Options: options{"endpoint": srv.URL},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	return cf, p
+}
+
+func TestCloudflareTLSA(t *testing.T) {
+	d, err := toCloudflareTLSA("3 1 1 ABCDEF")
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &cloudflareTLSA{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "abcdef"}, d, "Expected structured rdata")
+	assert.Equal(t, "3 1 1 abcdef", d.String(), "Expected presentation format")
+
+	_, err = toCloudflareTLSA("3 1")
+	assert.Error(t, err, "Expected short rdata to be refused")
+}
+
+func TestCloudflareList(t *testing.T) {
+	_, p := newTestCloudflare(t,
+		cloudflareRecord{Type: "TLSA", Name: "_443._tcp.example.com", TTL: 300, Data: &cloudflareTLSA{3, 1, 1, "abcdef"}},
+		cloudflareRecord{Type: "TLSA", Name: "_443._tcp.example.com", TTL: 300, Data: &cloudflareTLSA{2, 1, 1, "123456"}},
+		cloudflareRecord{Type: "TXT", Name: "_443._tcp.example.com", TTL: 300, Content: "cdh a b"},
+	)
+
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef", "2 1 1 123456"},
+		},
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TXT",
+			TTL:     300,
+			Rrdatas: []string{`"cdh a b"`},
+		},
+	}, rr, "Expected records grouped into RRsets")
+}
+
+func TestCloudflareApply(t *testing.T) {
+	cf, p := newTestCloudflare(t,
+		cloudflareRecord{Type: "TLSA", Name: "_443._tcp.example.com", TTL: 300, Data: &cloudflareTLSA{3, 1, 1, "0000"}},
+		cloudflareRecord{Type: "TLSA", Name: "_443._tcp.example.com", TTL: 300, Data: &cloudflareTLSA{2, 1, 1, "123456"}},
+		cloudflareRecord{Type: "TLSA", Name: "_443._tcp.old.example.com", TTL: 300, Data: &cloudflareTLSA{3, 1, 1, "0000"}},
+	)
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("abcdef", "123456", "example.com.", "www.example.com.")
+	c, _ := newChange(rr, d, changeOptions{})
+	c.Deletions = append(c.Deletions, rr[1])
+
+	_, err = p.Apply(context.Background(), c)
+	assert.NoError(t, err, "Expected no error")
+
+	assert.Equal(t, []string{
+		"PUT 1 3 1 1 abcdef",
+		"DELETE 3",
+		"POST 3 1 1 abcdef",
+		"POST 2 1 1 123456",
+	}, cf.calls, "Expected unchanged record to be kept")
+
+	rr, err = p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, rr, 2, "Expected two RRsets")
+}
+
+func TestCloudflareBadToken(t *testing.T) {
+	srv := httptest.NewServer(&testCloudflare{})
+	t.Cleanup(srv.Close)
+	t.Setenv("CLOUDFLARE_API_TOKEN", "wrong")
+
+	_, err := newCloudflareProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"endpoint": srv.URL},
+	})
+
+	assert.ErrorContains(t, err, "9109 Invalid access token", "Expected API error")
+}
+
+func TestCloudflareTXT(t *testing.T) {
+	cf, p := newTestCloudflare(t)
+
+	_, err := p.Apply(context.Background(), &changeset{
+		Additions: []*rrset{{Name: "_443._tcp.example.com.", Type: "TXT", TTL: 300, Rrdatas: []string{`"cdh \"quoted\"\059"`}}},
+	})
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, `cdh "quoted";`, cf.records["1"].Content, "Expected text without quoting")
+	assert.Equal(t, []string{`POST "cdh \"quoted\";"`}, cf.calls, "Expected TXT record to be created")
+}
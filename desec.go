@@ -0,0 +1,252 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// desecEndpoint is the default base URL of the deSEC API.
+const desecEndpoint = "https://desec.io/api/v1"
+
+// desecRetries is the number of times a rate-limited request is retried.
+const desecRetries = 5
+
+// desecRRset is an RRset in the deSEC API. Subname is relative to the
+// domain and empty at the apex.
+type desecRRset struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+// desecProvider manages TLSA records of a domain hosted at deSEC.
+type desecProvider struct {
+	endpoint string
+	token    string
+	domain   string
+	minTTL   int64
+	client   *http.Client
+}
+
+// newDESECProvider creates a deSEC provider. The key file holds the API
+// token; without it DESEC_TOKEN is used. The zone is the domain name.
+func newDESECProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	token := os.Getenv("DESEC_TOKEN")
+	if cfg.KeyFile != "" {
+		data, err := os.ReadFile(filepath.Clean(cfg.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("desec: no API token")
+	}
+
+	endpoint := cfg.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = desecEndpoint
+	}
+
+	p := &desecProvider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+		domain:   strings.TrimSuffix(dns.Fqdn(cfg.Zone), "."),
+		minTTL:   3600,
+		client:   http.DefaultClient,
+	}
+
+	if s, ok := cfg.Options["min-ttl"]; ok {
+		ttl, ok := parseTTL(s)
+		if !ok {
+			return nil, fmt.Errorf("desec: invalid min-ttl %q", s)
+		}
+		p.minTTL = int64(ttl)
+	}
+
+	return p, nil
+}
+
+// do sends an authenticated request to the deSEC API and decodes the JSON
+// response into out. Requests answered with 429 are retried after the delay
+// given by Retry-After.
+func (p *desecProvider) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var data []byte
+	if in != nil {
+		var err error
+		if data, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	u := p.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for try := 0; ; try++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Token "+p.token)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && try < desecRetries {
+			delay := time.Second
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				delay = time.Duration(s) * time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("desec: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(body, out)
+	}
+}
+
+// fqdn returns the fully qualified name of a subname of the domain.
+func (p *desecProvider) fqdn(subname string) string {
+	if subname == "" {
+		return p.domain + "."
+	}
+	return subname + "." + p.domain + "."
+}
+
+// subname returns name relative to the domain.
+func (p *desecProvider) subname(name string) (string, error) {
+	name = strings.TrimSuffix(dns.Fqdn(name), ".")
+	if strings.EqualFold(name, p.domain) {
+		return "", nil
+	}
+	if !dns.IsSubDomain(p.domain+".", name+".") {
+		return "", fmt.Errorf("desec: %s is not in %s", name, p.domain)
+	}
+	return name[:len(name)-len(p.domain)-1], nil
+}
+
+// List returns the TLSA and TXT resource record sets of the domain.
+func (p *desecProvider) List(ctx context.Context) ([]*rrset, error) {
+	var sets []desecRRset
+	for _, t := range managedTypes {
+		var s []desecRRset
+		err := p.do(ctx, http.MethodGet, "/domains/"+p.domain+"/rrsets/", url.Values{"type": {t}}, nil, &s)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, s...)
+	}
+
+	rr := make([]*rrset, 0, len(sets))
+	for _, s := range sets {
+		rr = append(rr, &rrset{
+			Name:    p.fqdn(s.Subname),
+			Type:    s.Type,
+			TTL:     s.TTL,
+			Rrdatas: s.Records,
+		})
+	}
+
+	return rr, nil
+}
+
+// Apply replaces the changed RRsets with one bulk PUT. Deleted RRsets are
+// sent with no records; TTLs below the minimum of the domain are raised.
+func (p *desecProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	var sets []desecRRset
+	index := make(map[string]int)
+
+	put := func(r *rrset, records []string) error {
+		sub, err := p.subname(r.Name)
+		if err != nil {
+			return err
+		}
+		ttl := r.TTL
+		if ttl < p.minTTL {
+			ttl = p.minTTL
+		}
+		s := desecRRset{Subname: sub, Type: r.Type, TTL: ttl, Records: records}
+
+		if i, ok := index[keyOf(r)]; ok {
+			sets[i] = s
+		} else {
+			index[keyOf(r)] = len(sets)
+			sets = append(sets, s)
+		}
+		return nil
+	}
+
+	for _, r := range c.Deletions {
+		if err := put(r, []string{}); err != nil {
+			return "", err
+		}
+	}
+	for _, r := range c.Additions {
+		if err := put(r, r.Rrdatas); err != nil {
+			return "", err
+		}
+	}
+
+	if err := p.do(ctx, http.MethodPut, "/domains/"+p.domain+"/rrsets/", nil, sets, nil); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// Wait returns immediately as deSEC applies the bulk change synchronously.
+func (p *desecProvider) Wait(ctx context.Context, id string) error {
+	return nil
+}
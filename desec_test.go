@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDESEC(t *testing.T, h http.Handler) provider {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Token test-token", r.Header.Get("Authorization"), "Expected token auth")
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("DESEC_TOKEN", "test-token")
+
+	p, err := newDESECProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"endpoint": srv.URL},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	return p
+}
+
+func TestDESECList(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /domains/example.com/rrsets/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") == "TXT" {
+			_ = json.NewEncoder(w).Encode([]desecRRset{
+				{Subname: "_443._tcp", Type: "TXT", TTL: 3600, Records: []string{`"cdh"`}},
+			})
+			return
+		}
+		assert.Equal(t, "TLSA", r.URL.Query().Get("type"), "Expected type filter")
+		_ = json.NewEncoder(w).Encode([]desecRRset{
+			{Subname: "_443._tcp", Type: "TLSA", TTL: 3600, Records: []string{"3 1 1 abcdef"}},
+			{Subname: "_443._tcp.www", Type: "TLSA", TTL: 3600, Records: []string{"3 1 1 abcdef"}},
+		})
+	})
+
+	p := newTestDESEC(t, mux)
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 abcdef"}},
+		{Name: "_443._tcp.www.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 abcdef"}},
+		{Name: "_443._tcp.example.com.", Type: "TXT", TTL: 3600, Rrdatas: []string{`"cdh"`}},
+	}, rr, "Expected fully qualified names")
+}
+
+func TestDESECApply(t *testing.T) {
+	var got []desecRRset
+	tries := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /domains/example.com/rrsets/", func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got), "Expected no error")
+		_ = json.NewEncoder(w).Encode(got)
+	})
+
+	p := newTestDESEC(t, mux)
+	_, err := p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 0000"}},
+			{Name: "_443._tcp.old.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 0000"}},
+		},
+		Additions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 abcdef"}},
+			{Name: "_443._tcp.www.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 abcdef"}},
+		},
+	})
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, 2, tries, "Expected rate-limited request to be retried")
+	assert.Equal(t, []desecRRset{
+		{Subname: "_443._tcp", Type: "TLSA", TTL: 3600, Records: []string{"3 1 1 abcdef"}},
+		{Subname: "_443._tcp.old", Type: "TLSA", TTL: 3600, Records: []string{}},
+		{Subname: "_443._tcp.www", Type: "TLSA", TTL: 3600, Records: []string{"3 1 1 abcdef"}},
+	}, got, "Expected replaced, deleted and raised RRsets")
+}
+
+func TestDESECRateLimit(t *testing.T) {
+	tries := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /domains/example.com/rrsets/", func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"detail":"Request was throttled."}`))
+	})
+
+	p := newTestDESEC(t, mux)
+	_, err := p.List(context.Background())
+
+	assert.ErrorContains(t, err, "Request was throttled", "Expected error after the last retry")
+	assert.Equal(t, desecRetries+1, tries, "Expected bounded retries")
+}
+
+func TestDESECOutsideZone(t *testing.T) {
+	p := newTestDESEC(t, http.NotFoundHandler())
+
+	_, err := p.Apply(context.Background(), &changeset{
+		Additions: []*rrset{{Name: "_443._tcp.example.org.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 abcdef"}}},
+	})
+
+	assert.ErrorContains(t, err, "not in example.com", "Expected foreign name to be refused")
+}
@@ -0,0 +1,450 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readKeyPair reads the private key file f and the public KEY or DNSKEY
+// record stored next to it with the .key extension, as written by
+// dnssec-keygen.
+func readKeyPair(f string) (dns.RR, crypto.Signer, error) {
+	pub := strings.TrimSuffix(f, ".private") + ".key"
+
+	pr, err := os.Open(filepath.Clean(pub))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pr.Close()
+
+	rr, err := dns.ReadRR(pr, pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var key *dns.DNSKEY
+	switch k := rr.(type) {
+	case *dns.KEY:
+		key = &k.DNSKEY
+	case *dns.DNSKEY:
+		key = k
+	default:
+		return nil, nil, fmt.Errorf("%s: not a KEY or DNSKEY record", pub)
+	}
+
+	kr, err := os.Open(filepath.Clean(f))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer kr.Close()
+
+	priv, err := key.ReadPrivateKey(kr, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: key cannot sign", f)
+	}
+
+	return rr, signer, nil
+}
+
+// zoneSigner signs RRsets with a zone signing key.
+type zoneSigner struct {
+	Key      *dns.DNSKEY
+	Signer   crypto.Signer
+	Validity time.Duration
+}
+
+// readZoneSigner reads a zone signing key from a K*.private file. The
+// signatures it makes are valid for the given duration.
+func readZoneSigner(f string, validity time.Duration) (*zoneSigner, error) {
+	rr, signer, err := readKeyPair(f)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a DNSKEY record", f)
+	}
+
+	return &zoneSigner{Key: key, Signer: signer, Validity: validity}, nil
+}
+
+// Sign returns the RRSIG of an RRset. The inception is set an hour in the
+// past to allow for clock skew.
+func (s *zoneSigner) Sign(rrs []dns.RR, now time.Time) (*dns.RRSIG, error) {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  s.Key.Algorithm,
+		KeyTag:     s.Key.KeyTag(),
+		SignerName: s.Key.Hdr.Name,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(s.Validity).Unix()),
+	}
+	if err := sig.Sign(s.Signer, rrs); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// canonicalLess reports whether name a sorts before b in the canonical order
+// of RFC 4034 section 6.1.
+func canonicalLess(a, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// zoneNames holds the authoritative owner names of a zone, their types,
+// and the delegation points.
+type zoneNames struct {
+	Types map[string][]uint16
+	Cuts  map[string]bool
+}
+
+// collectNames indexes the owner names of the zone. Names below a zone cut
+// are glue and are left out, as are the types of the denial chain.
+func collectNames(rrs []dns.RR, zone string) *zoneNames {
+	zone = strings.ToLower(zone)
+	types := make(map[string]map[uint16]bool)
+	cuts := make(map[string]bool)
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		switch h.Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			continue
+		case dns.TypeNS:
+			if name != zone {
+				cuts[name] = true
+			}
+		}
+		if !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		if types[name] == nil {
+			types[name] = make(map[uint16]bool)
+		}
+		types[name][h.Rrtype] = true
+	}
+
+	n := &zoneNames{Types: make(map[string][]uint16), Cuts: cuts}
+	for name, ts := range types {
+		if below(name, zone, cuts) {
+			continue
+		}
+		for t := range ts {
+			if cuts[name] && t != dns.TypeNS && t != dns.TypeDS {
+				continue
+			}
+			n.Types[name] = append(n.Types[name], t)
+		}
+		slices.Sort(n.Types[name])
+	}
+
+	return n
+}
+
+// ancestors returns the names between name and the zone apex, excluding
+// both.
+func ancestors(name, zone string) []string {
+	var names []string
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		parent := name[off:]
+		if parent == zone || !dns.IsSubDomain(zone, parent) {
+			break
+		}
+		names = append(names, parent)
+	}
+	return names
+}
+
+// below reports whether name is strictly below one of the zone cuts.
+func below(name, zone string, cuts map[string]bool) bool {
+	for _, parent := range ancestors(name, zone) {
+		if cuts[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// withTypes returns the sorted union of a type bitmap and extra types.
+func withTypes(ts []uint16, extra ...uint16) []uint16 {
+	out := append(slices.Clone(ts), extra...)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// nsecChain builds the NSEC chain of the zone.
+func nsecChain(n *zoneNames, zone string, ttl uint32) []dns.RR {
+	names := make([]string, 0, len(n.Types))
+	for name := range n.Types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+
+	chain := make([]dns.RR, 0, len(names))
+	for i, name := range names {
+		chain = append(chain, &dns.NSEC{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNSEC,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: withTypes(n.Types[name], dns.TypeRRSIG, dns.TypeNSEC),
+		})
+	}
+
+	return chain
+}
+
+// nsec3Chain builds the NSEC3 chain of the zone with the parameters of the
+// NSEC3PARAM record. With opt-out, delegations without DS are left out.
+func nsec3Chain(n *zoneNames, zone string, ttl uint32, param *dns.NSEC3PARAM, flags uint8) []dns.RR {
+	zone = strings.ToLower(zone)
+	bitmaps := make(map[string][]uint16)
+
+	for name, ts := range n.Types {
+		signed := true
+		if n.Cuts[name] {
+			signed = slices.Contains(ts, dns.TypeDS)
+			if !signed && flags&1 == 1 {
+				continue
+			}
+		}
+		if signed {
+			ts = withTypes(ts, dns.TypeRRSIG)
+		}
+		bitmaps[name] = ts
+
+		// Empty non-terminals are part of the NSEC3 chain.
+		for _, parent := range ancestors(name, zone) {
+			if _, ok := n.Types[parent]; !ok {
+				bitmaps[parent] = nil
+			}
+		}
+	}
+
+	type hashed struct {
+		hash string
+		name string
+	}
+	hashes := make([]hashed, 0, len(bitmaps))
+	for name := range bitmaps {
+		hashes = append(hashes, hashed{
+			hash: strings.ToLower(dns.HashName(name, param.Hash, param.Iterations, param.Salt)),
+			name: name,
+		})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].hash < hashes[j].hash })
+
+	chain := make([]dns.RR, 0, len(hashes))
+	for i, h := range hashes {
+		next := hashes[(i+1)%len(hashes)].hash
+		chain = append(chain, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   h.hash + "." + zone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Hash:       param.Hash,
+			Flags:      flags,
+			Iterations: param.Iterations,
+			SaltLength: param.SaltLength,
+			Salt:       param.Salt,
+			HashLength: uint8(len(next) * 5 / 8),
+			NextDomain: strings.ToUpper(next),
+			TypeBitMap: bitmaps[h.name],
+		})
+	}
+
+	return chain
+}
+
+// denialKey returns a canonical form of an NSEC or NSEC3 record, used to
+// find the records of the chain that changed.
+func denialKey(rr dns.RR) string {
+	switch r := rr.(type) {
+	case *dns.NSEC:
+		return strings.ToLower(r.NextDomain) + fmt.Sprint(withTypes(r.TypeBitMap))
+	case *dns.NSEC3:
+		return fmt.Sprint(
+			r.Hash, r.Flags, r.Iterations, strings.ToLower(r.Salt),
+			strings.ToLower(r.NextDomain), withTypes(r.TypeBitMap),
+		)
+	}
+	return rr.String()
+}
+
+// denialChain builds the NSEC or NSEC3 chain the zone should have, using the
+// same kind of chain, TTL and parameters as the existing one.
+func denialChain(rrs []dns.RR, zone string) ([]dns.RR, error) {
+	var soa *dns.SOA
+	var param *dns.NSEC3PARAM
+	var nsec, nsec3 dns.RR
+
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.SOA:
+			if strings.EqualFold(r.Hdr.Name, zone) {
+				soa = r
+			}
+		case *dns.NSEC3PARAM:
+			if strings.EqualFold(r.Hdr.Name, zone) {
+				param = r
+			}
+		case *dns.NSEC:
+			nsec = r
+		case *dns.NSEC3:
+			nsec3 = r
+		}
+	}
+	if soa == nil {
+		return nil, fmt.Errorf("no SOA record for %s", zone)
+	}
+
+	ttl := min(soa.Minttl, soa.Hdr.Ttl)
+	n := collectNames(rrs, zone)
+
+	switch {
+	case param != nil:
+		var flags uint8
+		if nsec3 != nil {
+			ttl = nsec3.Header().Ttl
+			flags = nsec3.(*dns.NSEC3).Flags
+		}
+		return nsec3Chain(n, zone, ttl, param, flags), nil
+	case nsec != nil:
+		return nsecChain(n, zone, nsec.Header().Ttl), nil
+	default:
+		return nil, fmt.Errorf("%s has no NSEC or NSEC3 chain", zone)
+	}
+}
+
+// resign re-signs the zone text after a changeset has been applied to it.
+// It signs the changed RRsets and the SOA, and updates the records of the
+// denial chain whose owner names or types changed.
+func (p *zonefileProvider) resign(text string, c *changeset) (string, error) {
+	all, err := readZoneRRs(strings.NewReader(text), p.zone, p.file)
+	if err != nil {
+		return "", err
+	}
+
+	index := make(map[string][]dns.RR)
+	for _, rr := range all {
+		k := rrKey(rr)
+		index[k] = append(index[k], rr)
+	}
+
+	now := p.now()
+	signs := &changeset{}
+	signed := make(map[string]bool)
+
+	sign := func(name string, t uint16, rrs []dns.RR) error {
+		k := rrsetKey(name, "RRSIG "+dns.TypeToString[t])
+		if signed[k] {
+			return nil
+		}
+		signed[k] = true
+
+		if old, ok := index[k]; ok {
+			signs.Deletions = append(signs.Deletions, fromRRs(old)...)
+		}
+		if len(rrs) == 0 {
+			return nil
+		}
+
+		sig, err := p.signer.Sign(rrs, now)
+		if err != nil {
+			return err
+		}
+		signs.Additions = append(signs.Additions, fromRRs([]dns.RR{sig})...)
+		return nil
+	}
+
+	for _, r := range append(slices.Clone(c.Deletions), c.Additions...) {
+		if err := sign(r.Name, dns.StringToType[r.Type], index[keyOf(r)]); err != nil {
+			return "", err
+		}
+	}
+	if err := sign(p.zone, dns.TypeSOA, index[rrsetKey(p.zone, "SOA")]); err != nil {
+		return "", err
+	}
+
+	chain, err := denialChain(all, p.zone)
+	if err != nil {
+		return "", err
+	}
+
+	existing := make(map[string]dns.RR)
+	for _, rr := range all {
+		if t := rr.Header().Rrtype; t == dns.TypeNSEC || t == dns.TypeNSEC3 {
+			existing[rrKey(rr)] = rr
+		}
+	}
+	for _, rr := range chain {
+		k := rrKey(rr)
+		if old, ok := existing[k]; ok {
+			delete(existing, k)
+			if denialKey(old) == denialKey(rr) {
+				continue
+			}
+			signs.Deletions = append(signs.Deletions, fromRRs([]dns.RR{old})...)
+		}
+		signs.Additions = append(signs.Additions, fromRRs([]dns.RR{rr})...)
+		if err := sign(rr.Header().Name, rr.Header().Rrtype, []dns.RR{rr}); err != nil {
+			return "", err
+		}
+	}
+	for _, old := range existing {
+		signs.Deletions = append(signs.Deletions, fromRRs([]dns.RR{old})...)
+		if err := sign(old.Header().Name, old.Header().Rrtype, nil); err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := parseZone(text, p.zone, p.file)
+	if err != nil {
+		return "", err
+	}
+
+	text, _, err = p.rewrite(entries, signs, false)
+	return text, err
+}
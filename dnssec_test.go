@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSignedZone = `$ORIGIN example.com.
+$TTL 3600
+@	IN	SOA	ns1 hostmaster 1 7200 3600 1209600 300
+@	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+www	IN	A	192.0.2.2
+_443._tcp	300	IN	TLSA	3 1 1 0000
+sub	IN	NS	ns.sub
+ns.sub	IN	A	192.0.2.3
+`
+
+// newTestSigner generates a zone signing key for example.com. in dir.
+func newTestSigner(t *testing.T, dir string) (string, *zoneSigner) {
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   "example.com.",
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	assert.NoError(t, err, "Expected no error")
+
+	base := filepath.Join(dir, "Kexample.com.+013+00001")
+	assert.NoError(t, os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644), "Expected no error")
+	assert.NoError(t, os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600), "Expected no error")
+
+	s, err := readZoneSigner(base+".private", 24*time.Hour)
+	assert.NoError(t, err, "Expected no error")
+
+	return base + ".private", s
+}
+
+// writeSignedZone signs testSignedZone with extra records and writes it.
+func writeSignedZone(t *testing.T, dir string, s *zoneSigner, extra string) string {
+	text := testSignedZone + s.Key.String() + "\n" + extra
+	rrs, err := readZoneRRs(strings.NewReader(text), "example.com.", "")
+	assert.NoError(t, err, "Expected no error")
+
+	chain, err := denialChain(append(rrs, &dns.NSEC{Hdr: dns.RR_Header{Rrtype: dns.TypeNSEC, Ttl: 300}}), "example.com.")
+	assert.NoError(t, err, "Expected no error")
+	rrs = append(rrs, chain...)
+
+	index := make(map[string][]dns.RR)
+	var keys []string
+	for _, rr := range rrs {
+		k := rrKey(rr)
+		if _, ok := index[k]; !ok {
+			keys = append(keys, k)
+		}
+		index[k] = append(index[k], rr)
+	}
+
+	var b strings.Builder
+	b.WriteString(text)
+	for _, rr := range chain {
+		b.WriteString(rr.String() + "\n")
+	}
+	n := collectNames(rrs, "example.com.")
+	for _, k := range keys {
+		set := index[k]
+		name := strings.ToLower(set[0].Header().Name)
+		if _, ok := n.Types[name]; !ok && set[0].Header().Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if n.Cuts[name] && set[0].Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		sig, err := s.Sign(set, time.Now())
+		assert.NoError(t, err, "Expected no error")
+		b.WriteString(sig.String() + "\n")
+	}
+
+	f := filepath.Join(dir, "example.com.zone")
+	assert.NoError(t, os.WriteFile(f, []byte(b.String()), 0o644), "Expected no error")
+	return f
+}
+
+// verifyZone checks that every signature in the file validates and that
+// every authoritative RRset is signed.
+func verifyZone(t *testing.T, f string, s *zoneSigner) []dns.RR {
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	rrs, err := readZoneRRs(strings.NewReader(string(data)), "example.com.", f)
+	assert.NoError(t, err, "Expected no error")
+
+	index := make(map[string][]dns.RR)
+	for _, rr := range rrs {
+		index[rrKey(rr)] = append(index[rrKey(rr)], rr)
+	}
+
+	n := collectNames(rrs, "example.com.")
+	for k, set := range index {
+		h := set[0].Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			sig := set[0].(*dns.RRSIG)
+			assert.Len(t, set, 1, "Expected one signature for %s", k)
+			assert.NoError(t, sig.Verify(s.Key, index[rrsetKey(h.Name, dns.TypeToString[sig.TypeCovered])]), "Expected %s to validate", k)
+			continue
+		}
+		name := strings.ToLower(h.Name)
+		if _, ok := n.Types[name]; !ok && h.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if n.Cuts[name] && h.Rrtype == dns.TypeNS {
+			continue
+		}
+		assert.Contains(t, index, rrsetKey(h.Name, "RRSIG "+dns.TypeToString[h.Rrtype]), "Expected %s to be signed", k)
+	}
+
+	return rrs
+}
+
+func TestCanonicalLess(t *testing.T) {
+	names := []string{
+		"example.com.",
+		"a.example.com.",
+		"yljkjljk.a.example.com.",
+		"Z.a.example.com.",
+		"zABC.a.EXAMPLE.com.",
+		"z.example.com.",
+		"*.z.example.com.",
+	}
+
+	for i := 0; i+1 < len(names); i++ {
+		assert.True(t, canonicalLess(names[i], names[i+1]), "Expected %s before %s", names[i], names[i+1])
+		assert.False(t, canonicalLess(names[i+1], names[i]), "Expected %s after %s", names[i+1], names[i])
+	}
+}
+
+func TestCollectNames(t *testing.T) {
+	rrs, err := readZoneRRs(strings.NewReader(testSignedZone), "example.com.", "")
+	assert.NoError(t, err, "Expected no error")
+
+	n := collectNames(rrs, "example.com.")
+
+	assert.Equal(t, []uint16{dns.TypeNS}, n.Types["sub.example.com."], "Expected delegation to keep NS only")
+	assert.NotContains(t, n.Types, "ns.sub.example.com.", "Expected glue to be left out")
+	assert.True(t, n.Cuts["sub.example.com."], "Expected zone cut")
+}
+
+func TestZonefileSignNSEC(t *testing.T) {
+	dir := t.TempDir()
+	key, s := newTestSigner(t, dir)
+	f := writeSignedZone(t, dir, s, "")
+	verifyZone(t, f, s)
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"file": f, "sign": key, "validity": "1d"},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("abcdef", "123456", "example.com.", "www.example.com.")
+	cset, _ := newChange(rr, d, changeOptions{})
+	_, err = p.Apply(context.Background(), cset)
+	assert.NoError(t, err, "Expected no error")
+
+	rrs := verifyZone(t, f, s)
+
+	nsec := make(map[string]*dns.NSEC)
+	for _, rr := range rrs {
+		if r, ok := rr.(*dns.NSEC); ok {
+			nsec[r.Hdr.Name] = r
+		}
+	}
+	assert.Len(t, nsec, 6, "Expected one NSEC per authoritative name")
+	assert.Equal(t, "_443._tcp.www.example.com.", nsec["www.example.com."].NextDomain, "Expected new name in the chain")
+	assert.Equal(t, "example.com.", nsec["_443._tcp.www.example.com."].NextDomain, "Expected chain to wrap")
+	assert.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC, dns.TypeTLSA}, nsec["_443._tcp.www.example.com."].TypeBitMap, "Expected TLSA in bitmap")
+}
+
+func TestZonefileSignNSEC3(t *testing.T) {
+	dir := t.TempDir()
+	key, s := newTestSigner(t, dir)
+	f := writeSignedZone(t, dir, s, "@ 0 IN NSEC3PARAM 1 0 0 -\n")
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"file": f, "sign": key},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("abcdef", "", "www.example.com.")
+	cset, _ := newChange(rr, d, changeOptions{})
+	_, err = p.Apply(context.Background(), cset)
+	assert.NoError(t, err, "Expected no error")
+
+	rrs := verifyZone(t, f, s)
+
+	nsec3 := make(map[string]*dns.NSEC3)
+	for _, rr := range rrs {
+		if r, ok := rr.(*dns.NSEC3); ok {
+			nsec3[strings.ToLower(r.Hdr.Name)] = r
+		}
+	}
+
+	owner := func(name string) string {
+		return strings.ToLower(dns.HashName(name, dns.SHA1, 0, "")) + ".example.com."
+	}
+	assert.Contains(t, nsec3, owner("_443._tcp.www.example.com."), "Expected NSEC3 for the new name")
+	assert.Contains(t, nsec3, owner("_tcp.www.example.com."), "Expected NSEC3 for the empty non-terminal")
+	assert.Empty(t, nsec3[owner("_tcp.www.example.com.")].TypeBitMap, "Expected empty bitmap")
+	assert.Len(t, nsec3, 8, "Expected one NSEC3 per name")
+}
+
+func TestDenialChainUnsigned(t *testing.T) {
+	rrs, err := readZoneRRs(strings.NewReader(testSignedZone), "example.com.", "")
+	assert.NoError(t, err, "Expected no error")
+
+	_, err = denialChain(rrs, "example.com.")
+
+	assert.ErrorContains(t, err, "no NSEC or NSEC3 chain", "Expected unsigned zone to be refused")
+}
@@ -16,23 +16,282 @@
 
 /*
 Cdh takes the domain names and path of the live certificate from certbot and
-update related TLSA records on Google Cloud DNS.
+update related TLSA records on a DNS provider.
 
 The domain names are passed via the environment variable RENEWED_DOMAINS. The
 path of the certificate is passed via RENEWED_LINEAGE.
 
-Currently Cdh only supports DANE certificate usage 3 (DANE-EE), selector 1 1
-(public key, SHA-256).
+Cdh publishes one TLSA record for each usage, selector and matching type given
+with -t, "3 1 1" (DANE-EE, public key, SHA-256) and "2 1 1" (DANE-TA) by
+default. Usages 1 (PKIX-EE) and 3 (DANE-EE) match the leaf certificate, and
+usages 0 (PKIX-TA) and 2 (DANE-TA) a CA certificate from the chain.
+Selectors 0 (full certificate) and 1 (public key) and matching types 0
+(exact), 1 (SHA-256) and 2 (SHA-512) are supported.
+Every configured record is required: cdh fails without changing anything if
+the chain does not provide the certificate for one of them.
 
 Usage:
 
 	cdh [flags]
+	cdh keygen [-a algorithm] [-d dir] name
+	cdh stage [flags] [-g type] [-c csr] key
+	cdh gc [flags] [-l dir]
+	cdh revoke [flags] [-F] hash|file...
+
+The chain in fullchain.pem is ordered by checking each signature, starting
+from the leaf, so the order of the file does not matter. Certificates that
+are not part of the chain are ignored. The CA certificates used for usages 0
+and 2 are chosen by the -a policy:
+
+	issuer	the intermediate that issued the leaf (default)
+	top	the topmost certificate of the chain
+	all	every CA certificate of the chain
+	subject=name	the CA with this subject or common name
+	spki=hash	the CA whose public key has this SHA-256 digest in hex
+
+With -i, the CA certificates in the *.pem files of the directory are also
+published as trust anchors. CAs such as Let's Encrypt issue from one of
+several sibling intermediates at random, so pinning the whole family keeps
+DANE-TA working across renewals. Expired certificates are not published.
+When certbot renews the lineage, trust anchors chosen from its chain that
+are not yet in the directory are saved there and files whose certificates
+have all expired are removed; the subcommands only read it.
+
+With -e, the end entity records of the previous certificate certbot keeps in
+archive/<lineage> stay published next to those of the new one until the
+grace window has passed since the new certificate was issued. The previous
+generation is found through the fullchain.pem link of the lineage, so this
+gives a rollover without a state file. The records are dropped by the first
+update after the window, so cdh should also be run periodically with
+RENEWED_LINEAGE set, not only by certbot.
+
+The records of each name are published at _port._proto.name for the services
+of the first -s rule matching the name, and at _443._tcp.name if none does.
+A rule such as "mail.example.com=25/tcp,465/tcp" maps a pattern to a list of
+port/proto services, where proto is tcp, udp or sctp and defaults to tcp.
+The pattern is an exact name, a suffix starting with a dot such as
+".example.com", or a glob such as "mx*.example.com". Only these owner names
+are changed: other TLSA records of the names, such as a hand-maintained
+_25._tcp record, are left alone and reported.
+
+By default an RRset is replaced with the records cdh derives. With -m, the
+records of the RRset that cdh did not publish are kept: only the records
+derived from the previous certificate certbot keeps in archive/<lineage>
+are retired, so records of other tools or added by hand stay even when
+they have the configured TLSA parameters. Records of the keys given with
+-b, such as the "3 1 1" record of an offline backup key kept for recovery
+as suggested by RFC 7671, are never retired; -b implies -m.
+
+With -r, cdh keeps a registry of the records it published in a TXT record
+next to each TLSA RRset, at the same owner name or, with -x prefix, at the
+sibling name whose first label starts with prefix. Each TXT string lists
+one record with the certbot lineage that published it and when:
+
+	cdh lineage=example.com tlsa=3-1-1:abcdef... added=2024-01-02T03:04:05Z
+
+where the SHA-256 digest stands in for the data of full-data records. Only
+records the registry lists for the renewed lineage, and for no other one,
+are retired; records from other tools or added by hand are never deleted,
+including those published before the registry was enabled. TXT strings not
+written by cdh are kept.
+
+The registry lets several lineages share a name, such as RSA and ECDSA
+certificates for the same host or mail and web certificates that overlap:
+each RRset is the union of the records of every lineage covering it, as a
+renewal only retires the records of its own lineage. When a lineage no
+longer covers a name or service, its records and registry entries there are
+removed on its next renewal, and RRsets left empty are deleted. Without -r
+the RRset is replaced, so the last renewal wins.
+
+With -f, records cdh retires, such as the "3 1 1" record of the previous key,
+stay published next to their successors for a hold period, twice the TTL
+of the RRset unless -w is given, so resolvers that cached the old RRset
+accept the new certificate. The file keeps the end of each hold period
+between runs, by zone, so one file may serve several zones and lineages. A
+record is retired by the first run of its zone that changes its RRset after
+the hold period is over, which is usually the gc subcommand.
 
 The flags are:
 
+	-a policy
+		trust anchor policy (default "issuer")
+	-b hash
+		SPKI SHA-256 digest of a pinned key, may be repeated
+	-e duration
+		grace window of the previous archived certificate
+	-f file
+		rollover state file, keeps retired records for the hold period,
+		staged keys and revoked keys
+	-i dir
+		directory of sibling intermediate certificates
 	-k string
-		path to the service account JSON key file
+		path to the provider key file
+	-m
+		keep the records cdh did not publish
+	-o name=value
+		provider option, may be repeated
+	-p string
+		name of the DNS provider (default "gcloud")
+	-r
+		keep an ownership registry in TXT records
+	-s pattern=port/proto,...
+		services of the names matching pattern, may be repeated
+	-t "usage selector type"
+		TLSA parameters to publish, may be repeated
+	-w duration
+		hold period of retired records (default twice the TTL)
+	-x prefix
+		prefix of the registry owner names, implies -r
 	-z string
 		name of the DNS zone
+
+The providers are:
+
+	cloudflare
+		Cloudflare v4 API. The key file holds a scoped API token with DNS
+		edit permission; without it CLOUDFLARE_API_TOKEN is used. The zone
+		is the name of the zone, whose ID is looked up unless zone-id is
+		set. Records that keep their rdata are not touched.
+		Options:
+			endpoint	API base URL, https://api.cloudflare.com/client/v4 by default
+			zone-id	ID of the zone
+	desec
+		deSEC REST API. The key file holds the API token; without it
+		DESEC_TOKEN is used. The zone is the domain name. All changed
+		RRsets are replaced with one bulk PUT, and rate-limited requests
+		are retried after the delay given by Retry-After.
+		Options:
+			endpoint	API base URL, https://desec.io/api/v1 by default
+			min-ttl	minimum TTL of the domain, 1h by default
+	exec
+		External plugin speaking the protocol described below. The key
+		file and the options other than command are passed to the plugin.
+		Options:
+			command	plugin executable and its arguments
+	gcloud
+		Google Cloud DNS. The key file is the service account JSON key and
+		the zone is the name of the managed zone.
+	powerdns
+		PowerDNS Authoritative HTTP API. The key file holds the API key sent
+		as X-API-Key. The zone is the name of the zone. RRsets are changed
+		with one PATCH using REPLACE and DELETE.
+		Options:
+			url	base URL of the API, such as http://127.0.0.1:8081
+			server	server ID, localhost by default
+			rectify	true to rectify the zone after the change
+			notify	true to send a NOTIFY to the secondaries after the change
+	rfc2136
+		DNS UPDATE (RFC 2136) sent to the primary server. The key file is a
+		BIND TSIG key file using hmac-sha256 or hmac-sha512, or a K*.private
+		SIG(0) key file with its K*.key next to it. The zone is the apex of
+		the zone. The records are listed with a zone transfer, which is not
+		signed when SIG(0) is used.
+		Options:
+			server	address of the primary server, port 53 by default
+	route53
+		AWS Route 53. The key file is an AWS shared credentials file; without
+		it the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+		environment variables are used, then ~/.aws/credentials. The zone is
+		the name of the hosted zone, which is looked up unless zone-id is set.
+		Changes are submitted as one batch and waited on until INSYNC.
+		Options:
+			endpoint	API endpoint, https://route53.amazonaws.com by default
+			profile	profile in the credentials file, AWS_PROFILE or default
+			zone-id	ID of the hosted zone
+	zonefile
+		Local master file. The zone is the origin of the file. Changed RRsets
+		are replaced in place and the SOA serial is bumped; the rest of the
+		file, including comments and directives, is kept as is. Records in
+		$INCLUDE files are read but not changed. The file is written
+		atomically.
+		Options:
+			file	path to the master file
+			serial	increment (default) or date for YYYYMMDDnn serials
+			reload	command to run after writing, such as "rndc reload"
+			sign	path to the K*.private file of the zone signing key
+			validity	lifetime of new signatures, 30d by default
+
+		With sign, the changed RRsets and the SOA are signed again and
+		the NSEC or NSEC3 chain is updated for added or removed names, so
+		the zone validates without running a separate signer.
+
+The exec provider runs the plugin once per operation. It writes one JSON
+request to the standard input of the plugin and reads one JSON response from
+its standard output; the standard error is passed through. A request is:
+
+	{
+		"version": 1,
+		"op": "list" | "apply" | "wait",
+		"zone": "example.com.",
+		"key_file": "/path/to/key",
+		"options": {"name": "value"},
+		"changes": {"deletions": [RRSET...], "additions": [RRSET...]},
+		"id": "change ID"
+	}
+
+where changes is only set for apply and id only for wait. An RRSET is:
+
+	{"name": "_443._tcp.example.com.", "type": "TLSA", "ttl": 300,
+	 "rrdatas": ["3 1 1 abcdef..."]}
+
+The response is:
+
+	{"version": 1, "rrsets": [RRSET...], "id": "change ID", "error": "..."}
+
+list returns the TLSA and TXT rrsets of the zone, apply applies the deletions
+and additions as a whole and may return an id, and wait returns once the
+change with that id is live. wait is not run if apply returned no id. A
+non-empty error or a non-zero exit status fails the operation. A plugin must
+reject requests with a version it does not know.
+
+The keygen subcommand generates a SIG(0) key pair for the rfc2136 provider.
+It writes the K*.key and K*.private files to the directory given by -d and
+prints the KEY record to publish at name. The algorithm defaults to
+ECDSAP256SHA256.
+
+The stage subcommand pre-publishes the next key of the lineage in
+RENEWED_LINEAGE, as RFC 7671 advises for a safe rollover. key is a private
+key or a certificate signing request; if the file does not exist, a new
+private key is generated there, ECDSA P-256 by default or RSA 2048 with
+-g rsa. -c writes a certificate signing request for the names of the
+lineage signed by the key. The records of the current certificate are
+published as usual, with the end entity records of the next key added to
+them; records matching the whole certificate (selector 0) cannot be staged.
+stage takes the same flags as an update and needs the rollover state file
+given with -f, which keeps the next key so every later update of the lineage
+publishes it too. Once the records have been live for longer than their TTL,
+renew with certbot using that key, for example with --csr, and the TLSA
+records of the new certificate are already in place. The key is dropped from
+the state once its certificate is live; a renewal with any other key retires
+the staged records like any other.
+
+The gc subcommand removes the retired records whose hold period is over,
+with their registry entries, in one change. It is meant for a systemd timer
+or cron job, as nothing runs between certbot renewals. It takes the flags of
+an update and needs the rollover state file given with -f. Records that a
+certificate in the certbot live directory, /etc/letsencrypt/live unless -l is
+given, still publishes are kept; lineages whose records cannot be derived
+are skipped. gc changes a single zone and fails, after changing it, if the
+state file has records of other zones to remove, so run it for every zone.
+
+The revoke subcommand removes the records of a compromised key from every
+TLSA RRset of the zone in one change, without waiting for a renewal. The key
+is given as a hex encoded SPKI SHA-256 digest, or a PEM file holding the
+certificate, the private key or a certificate signing request. Records
+matching the whole certificate (selector 0) are only found if the certificate
+is given. The other records, such as those of a backup or staged key, are
+kept, and the registry entries of the removed records are dropped with -r.
+revoke refuses to leave an RRset without records, which would break DANE for
+the service: publish the replacement first, for example with stage, or force
+the deletion with -F. It takes the flags of an update and changes a single
+zone, so run it once for every zone that publishes the key: it fails, after
+changing the zone, while the key has not been revoked in every zone the
+state file knows of.
+
+revoke needs the rollover state file given with -f, where the key is added
+to a deny-list. Later runs sharing the file never publish it again: it is
+left out of the archive grace window and of the trust anchors, dropped from
+the staged keys, and its records are not held for a rollover. An update of a
+certificate with the revoked key fails until it is renewed with a new key.
 */
 package main
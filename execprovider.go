@@ -0,0 +1,151 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// execVersion is the version of the plugin protocol spoken by cdh.
+const execVersion = 1
+
+// execRequest is written as one line of JSON to the standard input of the
+// plugin.
+type execRequest struct {
+	Version int               `json:"version"`
+	Op      string            `json:"op"`
+	Zone    string            `json:"zone"`
+	KeyFile string            `json:"key_file,omitempty"`
+	Options map[string]string `json:"options"`
+	Changes *changeset        `json:"changes,omitempty"`
+	ID      string            `json:"id,omitempty"`
+}
+
+// execResponse is read as JSON from the standard output of the plugin.
+type execResponse struct {
+	Version int      `json:"version"`
+	Error   string   `json:"error,omitempty"`
+	RRsets  []*rrset `json:"rrsets,omitempty"`
+	ID      string   `json:"id,omitempty"`
+}
+
+// execProvider delegates to an external command speaking the plugin
+// protocol. The command is run once per operation.
+type execProvider struct {
+	command []string
+	zone    string
+	keyFile string
+	options map[string]string
+}
+
+// newExecProvider creates a provider for the plugin given by the command
+// option. The other options are passed on to the plugin.
+func newExecProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	command, err := cfg.Options.Require("command")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := make(map[string]string)
+	for k, v := range cfg.Options {
+		if k != "command" {
+			opts[k] = v
+		}
+	}
+
+	return &execProvider{
+		command: strings.Fields(command),
+		zone:    dns.Fqdn(cfg.Zone),
+		keyFile: cfg.KeyFile,
+		options: opts,
+	}, nil
+}
+
+// call runs the plugin with a request for op and returns its response. The
+// standard error of the plugin is passed through.
+func (p *execProvider) call(ctx context.Context, op string, c *changeset, id string) (*execResponse, error) {
+	req, err := json.Marshal(execRequest{
+		Version: execVersion,
+		Op:      op,
+		Zone:    p.zone,
+		KeyFile: p.keyFile,
+		Options: p.options,
+		Changes: c,
+		ID:      id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = bytes.NewReader(append(req, '\n'))
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", p.command[0], op, err)
+	}
+
+	var resp execResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid response: %w", p.command[0], op, err)
+	}
+	if resp.Version != execVersion {
+		return nil, fmt.Errorf("%s %s: unsupported protocol version %d", p.command[0], op, resp.Version)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s %s: %s", p.command[0], op, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// List asks the plugin for the TLSA and TXT resource record sets in the zone.
+func (p *execProvider) List(ctx context.Context) ([]*rrset, error) {
+	resp, err := p.call(ctx, "list", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.RRsets, nil
+}
+
+// Apply passes the changeset to the plugin and returns the ID it reports.
+func (p *execProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	resp, err := p.call(ctx, "apply", c, "")
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// Wait asks the plugin to block until the change is live. Nothing is run
+// if the plugin returned no ID from apply.
+func (p *execProvider) Wait(ctx context.Context, id string) error {
+	if id == "" {
+		return nil
+	}
+	_, err := p.call(ctx, "wait", nil, id)
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestExec(t *testing.T, command string) (string, provider) {
+	dir := t.TempDir()
+
+	p, err := newExecProvider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		Options: options{"command": command, "state": dir},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	return dir, p
+}
+
+func TestExecPlugin(t *testing.T) {
+	dir, p := newTestExec(t, "sh testdata/exec-plugin.sh")
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+	assert.Empty(t, rr, "Expected empty zone")
+
+	current := []*rrset{
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 0000"}},
+	}
+	data, err := json.Marshal(current)
+	assert.NoError(t, err, "Expected no error")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "rrsets.json"), data, 0o644), "Expected no error")
+
+	rr, err = p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, current, rr, "Expected RRsets from the plugin")
+
+	c, _ := newChange(rr, testTLSA("abcdef", "", "example.com."), changeOptions{})
+	id, err := p.Apply(context.Background(), c)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "1", id, "Expected change ID from the plugin")
+
+	log, err := os.ReadFile(filepath.Join(dir, "changes.log"))
+	assert.NoError(t, err, "Expected no error")
+	var got changeset
+	assert.NoError(t, json.Unmarshal(log, &got), "Expected changeset in the log")
+	assert.Equal(t, *c, got, "Expected changeset to reach the plugin")
+
+	assert.NoError(t, p.Wait(context.Background(), id), "Expected no error")
+	assert.ErrorContains(t, p.Wait(context.Background(), "7"), "unknown change 7", "Expected plugin error")
+}
+
+func TestExecRequest(t *testing.T) {
+	dir, p := newTestExec(t, "sh")
+	p.(*execProvider).command = []string{"sh", "-c", `cat > "$0"; echo '{"version":1}'`, filepath.Join(dir, "req")}
+
+	_, err := p.Apply(context.Background(), &changeset{})
+	assert.NoError(t, err, "Expected no error")
+
+	data, err := os.ReadFile(filepath.Join(dir, "req"))
+	assert.NoError(t, err, "Expected no error")
+	assert.JSONEq(t, `{
+		"version": 1,
+		"op": "apply",
+		"zone": "example.com.",
+		"options": {"state": "`+dir+`"},
+		"changes": {"deletions": null, "additions": null}
+	}`, string(data), "Expected request to match the schema")
+}
+
+func TestExecErrors(t *testing.T) {
+	for cmd, want := range map[string]string{
+		`echo '{"version":2}'`:                  "unsupported protocol version 2",
+		`echo 'not json'`:                       "invalid response",
+		`echo '{"version":1,"error":"denied"}'`: "denied",
+		`exit 3`:                                "exit status 3",
+	} {
+		_, p := newTestExec(t, "sh")
+		p.(*execProvider).command = []string{"sh", "-c", cmd}
+
+		_, err := p.List(context.Background())
+
+		assert.ErrorContains(t, err, want, "Expected %q to fail", cmd)
+	}
+}
+
+func TestExecMissingCommand(t *testing.T) {
+	_, err := newExecProvider(context.Background(), providerConfig{Options: options{}})
+
+	assert.ErrorContains(t, err, `missing option "command"`, "Expected missing command to be refused")
+}
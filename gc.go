@@ -0,0 +1,184 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// readLive returns the TLSA records of the certificates of every lineage in
+// dir, the live directory of certbot. Lineages whose records cannot be
+// derived publish nothing and are skipped.
+func readLive(dir string) (map[string]bool, error) {
+	files, err := filepath.Glob(filepath.Join(filepath.Clean(dir), "*", "fullchain.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for _, f := range files {
+		t, err := readCert(filepath.Dir(f), certOpts)
+		if err != nil {
+			log.Printf("skipping lineage: %v", err)
+			continue
+		}
+		for _, r := range t.Records {
+			live[r.String()] = true
+		}
+	}
+
+	return live, nil
+}
+
+// gcChange returns the changeset that removes the records of rR whose hold
+// period is over and that no lineage in live publishes, along with their
+// registry entries. The removed records, and those already gone from rR, are
+// dropped from the state.
+func gcChange(rR []*rrset, s *rollover, live map[string]bool, o changeOptions) *changeset {
+	cset := changeset{}
+
+	registry := make(map[string]*rrset)
+	for _, r := range rR {
+		if r.Type == "TXT" {
+			registry[strings.ToLower(r.Name)] = r
+		}
+	}
+
+	for _, r := range rR {
+		if r.Type != "TLSA" {
+			continue
+		}
+
+		var keep, gone []string
+		removed := make(map[string]bool)
+		for _, rd := range r.Rrdatas {
+			rec, err := parseRRData(rd)
+			switch {
+			case err != nil || !s.Due(r.Name, rd):
+				keep = append(keep, rd)
+			case live[rec.String()]:
+				log.Printf("%s %s is retired but still live, keeping it", r.Name, rd)
+				keep = append(keep, rd)
+			default:
+				log.Printf("removing %s %s", r.Name, rd)
+				removed[registryID(rec)] = true
+				gone = append(gone, rd)
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		s.Forget(r.Name, gone)
+
+		cset.Deletions = append(cset.Deletions, r)
+		if len(keep) > 0 {
+			cset.Additions = append(cset.Additions, &rrset{Name: r.Name, Type: r.Type, TTL: r.TTL, Rrdatas: keep})
+		}
+		if o.Registry {
+			dropEntries(&cset, registry[strings.ToLower(registryOwner(r.Name, o.RegistryPrefix))], removed)
+		}
+	}
+	s.Prune(rR)
+
+	return &cset
+}
+
+// gc removes the retired records of the zone whose hold period is over in
+// one change. It is meant to be run periodically, between certbot renewals,
+// for every zone of the state file, and fails if other zones have records
+// to remove.
+func gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	registerFlags(fs)
+	liveDir := fs.String("l", "/etc/letsencrypt/live", "directory of the certbot lineages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: cdh gc [flags] [-l dir]")
+	}
+	if rolloverFile == "" {
+		return errors.New("gc needs the rollover state file given with -f")
+	}
+
+	ctx := context.Background()
+	changeOpts.Registry = changeOpts.Registry || changeOpts.RegistryPrefix != ""
+
+	if err := loadState(); err != nil {
+		return err
+	}
+	s := changeOpts.Rollover
+
+	live, err := readLive(*liveDir)
+	if err != nil {
+		return err
+	}
+
+	p, err := newProvider(ctx, providerName, providerConfig{
+		Zone:    zone,
+		KeyFile: keyPath,
+		Options: providerOpts,
+	})
+	if err != nil {
+		return err
+	}
+
+	records, err := p.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	cset := gcChange(records, s, live, changeOpts)
+	if cset.Empty() {
+		fmt.Println("unchanged")
+		if err = s.Save(); err != nil {
+			return err
+		}
+		return dueElsewhere(s)
+	}
+
+	id, err := p.Apply(ctx, cset)
+	if err != nil {
+		return err
+	}
+
+	if err = p.Wait(ctx, id); err != nil {
+		return err
+	}
+
+	if err = s.Save(); err != nil {
+		return err
+	}
+
+	fmt.Println("done")
+	return dueElsewhere(s)
+}
+
+// dueElsewhere returns an error naming the other zones of the state file
+// that have records to remove, as gc only changes the zone it is run for.
+func dueElsewhere(s *rollover) error {
+	if zones := s.DueElsewhere(); len(zones) > 0 {
+		return fmt.Errorf("retired records of %s are due, run gc for those zones too", strings.Join(zones, ", "))
+	}
+	return nil
+}
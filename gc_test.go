@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLive(t *testing.T) {
+	c := newTestChain(t)
+	live := t.TempDir()
+	lineage := writeFullchain(t, c.Leaf.Cert, c.Inter.Cert)
+	assert.NoError(t, os.Rename(lineage, filepath.Join(live, "example.com")), "Expected no error")
+	assert.NoError(t, os.WriteFile(filepath.Join(live, "README"), []byte("certbot\n"), 0o644), "Expected no error")
+	// Without an intermediate, "2 1 1" cannot be derived.
+	broken := writeFullchain(t, newTestCert(t, "broken.example.com", false, c.Root, nil).Cert)
+	assert.NoError(t, os.Rename(broken, filepath.Join(live, "broken.example.com")), "Expected no error")
+
+	got, err := readLive(live)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, map[string]bool{
+		"3 1 1 " + spkiHash(c.Leaf.Cert):  true,
+		"2 1 1 " + spkiHash(c.Inter.Cert): true,
+	}, got, "Expected records of every lineage")
+}
+
+func TestGCChange(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	owner := "_443._tcp.example.com."
+	entry := func(record string) string {
+		return `"` + registryEntry{"example.com", record, now}.String() + `"`
+	}
+	existing := []*rrset{
+		{Name: owner, Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 aaaa", "3 1 1 bbbb", "3 1 1 cccc", "3 1 1 dddd"}},
+		{Name: owner, Type: "TXT", TTL: 300, Rrdatas: []string{entry("3-1-1:aaaa"), entry("3-1-1:bbbb"), entry("3-1-1:dddd")}},
+		{Name: "_443._tcp.www.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 aaaa"}},
+	}
+
+	s, err := loadRollover(filepath.Join(t.TempDir(), "rollover.json"), "example.com", time.Hour, now)
+	assert.NoError(t, err, "Expected no error")
+	r := existing[0]
+	s.Hold(r, "3 1 1 aaaa") // superseded
+	s.Hold(r, "3 1 1 cccc") // live again in another lineage
+	s.now = now.Add(30 * time.Minute)
+	s.Hold(r, "3 1 1 dddd") // still in its hold period
+	s.now = now.Add(time.Hour)
+
+	cset := gcChange(existing, s, map[string]bool{"3 1 1 cccc": true}, changeOptions{Registry: true})
+
+	assert.Equal(t, existing[:2], cset.Deletions, "Expected only the RRsets with due records to change")
+	assert.Equal(t, []*rrset{
+		{Name: owner, Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 bbbb", "3 1 1 cccc", "3 1 1 dddd"}},
+		{Name: owner, Type: "TXT", TTL: 300, Rrdatas: []string{entry("3-1-1:bbbb"), entry("3-1-1:dddd")}},
+	}, cset.Additions, "Expected superseded record and its registry entry to be removed")
+}
+
+func TestGC(t *testing.T) {
+	zone := writeTestZone(t)
+	state := filepath.Join(t.TempDir(), "rollover.json")
+	other := `{"zone": "example.net.", "owner": "_443._tcp.example.net.", "rdata": "3 1 1 0000", "until": "2000-01-01T00:00:00Z"}`
+	assert.NoError(t, os.WriteFile(state, []byte(`{"version": 1, "retired": [
+		{"zone": "example.com.", "owner": "_443._tcp.example.com.", "rdata": "3 1 1 0000", "until": "2000-01-01T00:00:00Z"},
+		{"zone": "example.com.", "owner": "_443._tcp.gone.example.com.", "rdata": "3 1 1 0000", "until": "2000-01-01T00:00:00Z"},
+		`+other+`
+	]}`), 0o600), "Expected no error")
+	t.Cleanup(func() {
+		providerOpts = options{}
+		rolloverFile = ""
+	})
+
+	err := gc([]string{"-p", "zonefile", "-z", "example.com.", "-o", "file=" + zone, "-f", state, "-l", t.TempDir()})
+	assert.ErrorContains(t, err, "example.net.", "Expected the other zone with due records to be reported")
+
+	data, err := os.ReadFile(zone)
+	assert.NoError(t, err, "Expected no error")
+	assert.False(t, strings.Contains(string(data), "3 1 1 0000"), "Expected retired record to be removed")
+	assert.True(t, strings.Contains(string(data), "2 1 1 1111"), "Expected other records to be kept")
+
+	data, err = os.ReadFile(state)
+	assert.NoError(t, err, "Expected no error")
+	assert.JSONEq(t, `{"version": 1, "retired": [`+other+`]}`, string(data), "Expected only the records of the zone to be dropped")
+}
+
+func TestGCAfterUpdate(t *testing.T) {
+	f := writeTestZone(t)
+	state := filepath.Join(t.TempDir(), "rollover.json")
+	providerName, zone, providerOpts = "zonefile", "example.com.", options{"file": f}
+	rolloverFile, rolloverHold = state, time.Nanosecond
+	t.Cleanup(func() {
+		providerName, zone, providerOpts = "", "", options{}
+		rolloverFile, rolloverHold = "", 0
+		changeOpts = changeOptions{}
+	})
+
+	// The renewal holds the old key, then another lineage renews after the
+	// hold period is over.
+	assert.NoError(t, loadState(), "Expected no error")
+	assert.NoError(t, update(context.Background(), "example.com", testTLSA("abcd", "1111", "example.com.")), "Expected no error")
+	assert.NoError(t, loadState(), "Expected no error")
+	assert.NoError(t, update(context.Background(), "other", testTLSA("eeee", "1111", "other.example.com.")), "Expected no error")
+
+	data, err := os.ReadFile(state)
+	assert.NoError(t, err, "Expected no error")
+	assert.Contains(t, string(data), "3 1 1 0000", "Expected the unrelated update to keep the held record")
+
+	err = gc([]string{"-p", "zonefile", "-z", "example.com.", "-o", "file=" + f, "-f", state, "-w", "1ns", "-l", t.TempDir()})
+	assert.NoError(t, err, "Expected no error")
+
+	data, err = os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.NotContains(t, string(data), "3 1 1 0000", "Expected held record to be removed")
+	assert.Contains(t, string(data), "3 1 1 abcd", "Expected new record to be kept")
+}
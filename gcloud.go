@@ -0,0 +1,160 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	gcdns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+)
+
+// gcloudProvider manages TLSA records in a Google Cloud DNS managed zone.
+type gcloudProvider struct {
+	svc      *gcdns.Service
+	project  string
+	zone     string
+	interval time.Duration
+}
+
+// newGCloudProvider creates a Cloud DNS provider from the service account key
+// file and the name of the managed zone.
+func newGCloudProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	svc, project, err := newDNSClient(ctx, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcloudProvider{
+		svc:      svc,
+		project:  project,
+		zone:     cfg.Zone,
+		interval: 5 * time.Second,
+	}, nil
+}
+
+// newDNSClient reads a JSON key file and returns a DNS client, the project ID,
+// and any error that occurred.
+func newDNSClient(ctx context.Context, f string) (*gcdns.Service, string, error) {
+	var projectID string
+	var err error
+
+	data, err := os.ReadFile(filepath.Clean(f))
+	if err != nil {
+		return nil, projectID, err
+	}
+
+	var info map[string]string
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, projectID, err
+	}
+	if p, ok := info["project_id"]; ok {
+		projectID = p
+	}
+
+	dnsSer, err := gcdns.NewService(
+		ctx,
+		option.WithCredentialsJSON(data),
+		option.WithScopes(gcdns.NdevClouddnsReadwriteScope),
+	)
+	if err != nil {
+		return nil, projectID, err
+	}
+
+	return dnsSer, projectID, nil
+}
+
+// List returns the TLSA and TXT resource record sets in the managed zone.
+func (p *gcloudProvider) List(ctx context.Context) ([]*rrset, error) {
+	var rr []*rrset
+
+	err := p.svc.ResourceRecordSets.List(p.project, p.zone).Pages(
+		ctx,
+		func(resp *gcdns.ResourceRecordSetsListResponse) error {
+			for _, r := range resp.Rrsets {
+				if !managedType(r.Type) {
+					continue
+				}
+				rr = append(rr, &rrset{
+					Name:    r.Name,
+					Type:    r.Type,
+					TTL:     r.Ttl,
+					Rrdatas: r.Rrdatas,
+				})
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
+}
+
+// Apply creates a Cloud DNS change from the changeset and returns its ID.
+func (p *gcloudProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	change := gcdns.Change{}
+	for _, r := range c.Deletions {
+		change.Deletions = append(change.Deletions, toGCloud(r))
+	}
+	for _, r := range c.Additions {
+		change.Additions = append(change.Additions, toGCloud(r))
+	}
+
+	resp, err := p.svc.Changes.Create(p.project, p.zone, &change).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Id, nil
+}
+
+// Wait polls the change until Cloud DNS reports it as done.
+func (p *gcloudProvider) Wait(ctx context.Context, id string) error {
+	for {
+		resp, err := p.svc.Changes.Get(p.project, p.zone, id).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		if resp.Status == "done" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+// toGCloud converts an rrset to a Cloud DNS resource record set.
+func toGCloud(r *rrset) *gcdns.ResourceRecordSet {
+	return &gcdns.ResourceRecordSet{
+		Kind:    "dns#resourceRecordSet",
+		Name:    r.Name,
+		Ttl:     r.TTL,
+		Type:    r.Type,
+		Rrdatas: r.Rrdatas,
+	}
+}
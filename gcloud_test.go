@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	gcdns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+)
+
+func newTestGCloud(t *testing.T, h http.Handler) *gcloudProvider {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	svc, err := gcdns.NewService(
+		context.Background(),
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithoutAuthentication(),
+	)
+	assert.NoError(t, err, "Expected no error")
+
+	return &gcloudProvider{svc: svc, project: "p", zone: "z"}
+}
+
+func TestGCloudList(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dns/v1/projects/p/managedZones/z/rrsets", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(gcdns.ResourceRecordSetsListResponse{
+			Rrsets: []*gcdns.ResourceRecordSet{
+				{
+					Name:    "_443._tcp.example.com.",
+					Type:    "TLSA",
+					Ttl:     300,
+					Rrdatas: []string{"3 1 1 abcdef"},
+				},
+				{
+					Name:    "example.com.",
+					Type:    "A",
+					Ttl:     300,
+					Rrdatas: []string{"192.0.2.1"},
+				},
+			},
+		})
+	})
+
+	p := newTestGCloud(t, mux)
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef"},
+		},
+	}, rr, "Expected TLSA RRsets only")
+}
+
+func TestGCloudApplyWait(t *testing.T) {
+	var got gcdns.Change
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /dns/v1/projects/p/managedZones/z/changes", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(gcdns.Change{Id: "42", Status: "pending"})
+	})
+	polls := 0
+	mux.HandleFunc("GET /dns/v1/projects/p/managedZones/z/changes/42", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		status := "pending"
+		if polls > 1 {
+			status = "done"
+		}
+		_ = json.NewEncoder(w).Encode(gcdns.Change{Id: "42", Status: status})
+	})
+
+	p := newTestGCloud(t, mux)
+	id, err := p.Apply(context.Background(), &changeset{
+		Additions: []*rrset{
+			{
+				Name:    "_443._tcp.example.com.",
+				Type:    "TLSA",
+				TTL:     300,
+				Rrdatas: []string{"3 1 1 abcdef"},
+			},
+		},
+	})
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "42", id, "Expected change ID")
+	assert.Len(t, got.Additions, 1, "Expected one addition")
+	assert.Equal(t, "dns#resourceRecordSet", got.Additions[0].Kind, "Expected kind to be set")
+
+	err = p.Wait(context.Background(), id)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, 2, polls, "Expected to poll until done")
+}
@@ -0,0 +1,105 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// pinList is a list of SPKI SHA-256 digests given as repeated -b flags.
+// Records of these keys, such as an offline backup key, are never retired.
+type pinList []string
+
+// String returns the digests separated by commas.
+func (l *pinList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set parses a hex encoded SHA-256 digest and appends it to the list.
+func (l *pinList) Set(v string) error {
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("pinned key %q is not a hex encoded SHA-256 digest", v)
+	}
+	*l = append(*l, strings.ToLower(v))
+	return nil
+}
+
+// Pinned reports whether r is a SHA-256 digest of a pinned public key.
+func (l pinList) Pinned(r tlsaRecord) bool {
+	if r.Selector != 1 || r.MatchingType != 1 {
+		return false
+	}
+	for _, p := range l {
+		if strings.EqualFold(p, r.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRRData parses TLSA record data in presentation format. The data may
+// be split into several fields.
+func parseRRData(s string) (tlsaRecord, error) {
+	f := strings.Fields(s)
+	if len(f) < 4 {
+		return tlsaRecord{}, fmt.Errorf("TLSA record %q has no data", s)
+	}
+	p, err := parseTLSAParams(strings.Join(f[:3], " "))
+	if err != nil {
+		return tlsaRecord{}, err
+	}
+	return tlsaRecord{p, strings.ToLower(strings.Join(f[3:], ""))}, nil
+}
+
+// mergeRRData returns the record data of t followed by the records of old
+// that cdh did not publish or holds for a rollover. Only the records of the
+// previous certificate in t.Previous are retired, except those of pinned
+// keys; records of other tools or added by hand, even with the parameters
+// of t, and records it cannot parse are kept.
+func mergeRRData(old *rrset, t *tlsa, o changeOptions) []string {
+	previous := make(map[string]bool)
+	for _, r := range t.Previous {
+		previous[r.String()] = true
+	}
+
+	rrdatas := t.MakeRRData()
+	seen := make(map[string]bool)
+	for _, rd := range rrdatas {
+		seen[rd] = true
+	}
+
+	for _, rd := range old.Rrdatas {
+		r, err := parseRRData(rd)
+		if err != nil {
+			rrdatas = append(rrdatas, rd)
+			continue
+		}
+		if seen[r.String()] {
+			continue
+		}
+		if previous[r.String()] && !o.Pins.Pinned(r) && !o.Rollover.Hold(old, rd) {
+			continue
+		}
+		seen[r.String()] = true
+		rrdatas = append(rrdatas, rd)
+	}
+
+	return rrdatas
+}
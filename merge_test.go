@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPin = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestPinList(t *testing.T) {
+	var l pinList
+	assert.NoError(t, l.Set(strings.ToUpper(testPin)), "Expected no error")
+	assert.Equal(t, testPin, l.String(), "Expected digest in lower case")
+
+	assert.True(t, l.Pinned(tlsaRecord{tlsaParams{3, 1, 1}, testPin}), "Expected DANE-EE pin")
+	assert.True(t, l.Pinned(tlsaRecord{tlsaParams{2, 1, 1}, testPin}), "Expected DANE-TA pin")
+	assert.False(t, l.Pinned(tlsaRecord{tlsaParams{3, 0, 1}, testPin}), "Expected certificate digest not to match")
+
+	for _, v := range []string{"", "abcdef", "xyz" + testPin[3:]} {
+		assert.Error(t, l.Set(v), "Expected %q to be refused", v)
+	}
+}
+
+func TestParseRRData(t *testing.T) {
+	r, err := parseRRData("3 1 1 ABCD EF")
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, tlsaRecord{tlsaParams{3, 1, 1}, "abcdef"}, r, "Expected data to be joined")
+
+	for _, s := range []string{"3 1 1", "4 1 1 abcdef", "x"} {
+		_, err := parseRRData(s)
+		assert.Error(t, err, "Expected %q to be refused", s)
+	}
+}
+
+func TestMergeRRData(t *testing.T) {
+	d := testTLSA("abcdef", "123456")
+	d.Previous = []tlsaRecord{
+		{tlsaParams{3, 1, 1}, "000000"},
+		{tlsaParams{2, 1, 1}, "111111"},
+		{tlsaParams{3, 1, 1}, testPin},
+	}
+	old := []string{
+		"3 1 1 000000",      // previous key, retired
+		"2 1 1 111111",      // previous intermediate, retired
+		"3 1 1 " + testPin,  // backup key
+		"3 1 1 333333",      // published by hand
+		"3 0 1 222222",      // manual pin of the certificate
+		"3 1 1 ABCDEF",      // current key
+		"not a TLSA record", // kept as is
+	}
+
+	assert.Equal(t, []string{
+		"3 1 1 abcdef",
+		"2 1 1 123456",
+		"3 1 1 333333",
+		"3 0 1 222222",
+		"not a TLSA record",
+	}, mergeRRData(&rrset{Rrdatas: old}, d, changeOptions{}), "Expected foreign records to be kept")
+
+	assert.Equal(t, []string{
+		"3 1 1 abcdef",
+		"2 1 1 123456",
+		"3 1 1 " + testPin,
+		"3 1 1 333333",
+		"3 0 1 222222",
+		"not a TLSA record",
+	}, mergeRRData(&rrset{Rrdatas: old}, d, changeOptions{Pins: pinList{testPin}}), "Expected pinned key to be kept")
+}
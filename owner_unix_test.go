@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomicOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+
+	f := filepath.Join(t.TempDir(), "example.com.zone")
+	assert.NoError(t, os.WriteFile(f, []byte(testZone), 0o640), "Expected no error")
+	assert.NoError(t, os.Chown(f, 0, 53), "Expected no error")
+
+	assert.NoError(t, writeFileAtomic(f, []byte(testExtra)), "Expected no error")
+
+	info, err := os.Stat(f)
+	assert.NoError(t, err, "Expected no error")
+	st := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(53), st.Gid, "Expected group to be kept")
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm(), "Expected permissions to be kept")
+}
@@ -0,0 +1,226 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type powerDNSRRset struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int64            `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype,omitempty"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+type powerDNSZone struct {
+	RRsets []powerDNSRRset `json:"rrsets"`
+}
+
+// powerDNSProvider manages TLSA records through the PowerDNS Authoritative
+// HTTP API.
+type powerDNSProvider struct {
+	zoneURL string
+	apiKey  string
+	client  *http.Client
+	rectify bool
+	notify  bool
+}
+
+// newPowerDNSProvider creates a PowerDNS provider. The key file holds the
+// API key and the url option the base URL of the API.
+func newPowerDNSProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	base, err := cfg.Options.Require("url")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("powerdns: no API key file")
+	}
+
+	key, err := os.ReadFile(filepath.Clean(cfg.KeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	server := cfg.Options["server"]
+	if server == "" {
+		server = "localhost"
+	}
+
+	p := &powerDNSProvider{
+		zoneURL: strings.TrimSuffix(base, "/") + "/api/v1/servers/" + url.PathEscape(server) +
+			"/zones/" + url.PathEscape(dns.Fqdn(cfg.Zone)),
+		apiKey: strings.TrimSpace(string(key)),
+		client: http.DefaultClient,
+	}
+
+	for name, v := range map[string]*bool{"rectify": &p.rectify, "notify": &p.notify} {
+		if s, ok := cfg.Options[name]; ok {
+			if *v, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("powerdns: option %s: %w", name, err)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// do sends an authenticated request to the zone endpoint followed by path
+// and decodes the JSON response into out.
+func (p *powerDNSProvider) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.zoneURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("powerdns: %s %s: %s", method, req.URL.Path, e.Error)
+		}
+		return fmt.Errorf("powerdns: %s %s: %s", method, req.URL.Path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// List returns the TLSA and TXT resource record sets in the zone. Disabled
+// records are left out.
+func (p *powerDNSProvider) List(ctx context.Context) ([]*rrset, error) {
+	var z powerDNSZone
+	if err := p.do(ctx, http.MethodGet, "", nil, &z); err != nil {
+		return nil, err
+	}
+
+	var rr []*rrset
+	for _, s := range z.RRsets {
+		if !managedType(s.Type) {
+			continue
+		}
+		r := &rrset{Name: s.Name, Type: s.Type, TTL: s.TTL}
+		for _, rec := range s.Records {
+			if !rec.Disabled {
+				r.Rrdatas = append(r.Rrdatas, rec.Content)
+			}
+		}
+		if len(r.Rrdatas) > 0 {
+			rr = append(rr, r)
+		}
+	}
+
+	return rr, nil
+}
+
+// Apply replaces the added RRsets and deletes the others in one PATCH, then
+// rectifies the zone and sends a NOTIFY if configured to. The returned ID
+// is empty.
+func (p *powerDNSProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	added := make(map[string]bool)
+	for _, r := range c.Additions {
+		added[keyOf(r)] = true
+	}
+
+	var z powerDNSZone
+	for _, r := range c.Deletions {
+		if !added[keyOf(r)] {
+			z.RRsets = append(z.RRsets, powerDNSRRset{
+				Name:       r.Name,
+				Type:       r.Type,
+				ChangeType: "DELETE",
+				Records:    []powerDNSRecord{},
+			})
+		}
+	}
+	for _, r := range c.Additions {
+		s := powerDNSRRset{
+			Name:       r.Name,
+			Type:       r.Type,
+			TTL:        r.TTL,
+			ChangeType: "REPLACE",
+		}
+		for _, d := range r.Rrdatas {
+			s.Records = append(s.Records, powerDNSRecord{Content: d})
+		}
+		z.RRsets = append(z.RRsets, s)
+	}
+
+	if err := p.do(ctx, http.MethodPatch, "", z, nil); err != nil {
+		return "", err
+	}
+
+	if p.rectify {
+		if err := p.do(ctx, http.MethodPut, "/rectify", nil, nil); err != nil {
+			return "", err
+		}
+	}
+	if p.notify {
+		if err := p.do(ctx, http.MethodPut, "/notify", nil, nil); err != nil {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// Wait returns immediately as PowerDNS applies the PATCH synchronously.
+func (p *powerDNSProvider) Wait(ctx context.Context, id string) error {
+	return nil
+}
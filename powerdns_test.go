@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPowerDNSZone = "/api/v1/servers/localhost/zones/example.com."
+
+func newTestPowerDNS(t *testing.T, h http.Handler, opts options) provider {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"Unauthorized"}`))
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	key := filepath.Join(t.TempDir(), "api-key")
+	assert.NoError(t, os.WriteFile(key, []byte("secret\n"), 0o600), "Expected no error")
+
+	opts["url"] = srv.URL
+	p, err := newPowerDNSProvider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		KeyFile: key,
+		Options: opts,
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	return p
+}
+
+func TestPowerDNSList(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+testPowerDNSZone, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(powerDNSZone{
+			RRsets: []powerDNSRRset{
+				{Name: "example.com.", Type: "A", TTL: 300, Records: []powerDNSRecord{{Content: "192.0.2.1"}}},
+				{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Records: []powerDNSRecord{
+					{Content: "3 1 1 abcdef"},
+					{Content: "2 1 1 123456", Disabled: true},
+				}},
+			},
+		})
+	})
+
+	p := newTestPowerDNS(t, mux, options{})
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef"},
+		},
+	}, rr, "Expected enabled TLSA records only")
+}
+
+func TestPowerDNSApply(t *testing.T) {
+	var got powerDNSZone
+	var calls []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH "+testPowerDNSZone, func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "patch")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got), "Expected no error")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT "+testPowerDNSZone+"/rectify", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "rectify")
+		_, _ = w.Write([]byte(`{"result":"Rectified"}`))
+	})
+	mux.HandleFunc("PUT "+testPowerDNSZone+"/notify", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "notify")
+		_, _ = w.Write([]byte(`{"result":"Notification queued"}`))
+	})
+
+	p := newTestPowerDNS(t, mux, options{"rectify": "true", "notify": "1"})
+
+	_, err := p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 0000"}},
+			{Name: "_443._tcp.old.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 0000"}},
+		},
+		Additions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 abcdef"}},
+		},
+	})
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{"patch", "rectify", "notify"}, calls, "Expected rectify and notify after the patch")
+	assert.Equal(t, []powerDNSRRset{
+		{Name: "_443._tcp.old.example.com.", Type: "TLSA", ChangeType: "DELETE", Records: []powerDNSRecord{}},
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, ChangeType: "REPLACE", Records: []powerDNSRecord{{Content: "3 1 1 abcdef"}}},
+	}, got.RRsets, "Expected REPLACE and DELETE")
+}
+
+func TestPowerDNSError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH "+testPowerDNSZone, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"error":"Record _443._tcp.example.com./TLSA '3 1 1 zz': Parsing record content"}`))
+	})
+
+	p := newTestPowerDNS(t, mux, options{})
+	_, err := p.Apply(context.Background(), &changeset{
+		Additions: []*rrset{{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 zz"}}},
+	})
+
+	assert.ErrorContains(t, err, "Parsing record content", "Expected API error")
+}
+
+func TestPowerDNSBadOption(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "api-key")
+	assert.NoError(t, os.WriteFile(key, []byte("secret\n"), 0o600), "Expected no error")
+
+	_, err := newPowerDNSProvider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		KeyFile: key,
+		Options: options{"url": "http://127.0.0.1:8081", "rectify": "maybe"},
+	})
+
+	assert.ErrorContains(t, err, "option rectify", "Expected bad boolean to be refused")
+}
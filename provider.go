@@ -0,0 +1,226 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rrset is a provider-neutral resource record set. Names are fully qualified
+// and Rrdatas hold the presentation format of each record's data.
+type rrset struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int64    `json:"ttl"`
+	Rrdatas []string `json:"rrdatas"`
+}
+
+// RRs parses the RRset into miekg/dns resource records.
+func (r *rrset) RRs() ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(r.Rrdatas))
+	for _, d := range r.Rrdatas {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", r.Name, r.TTL, r.Type, d))
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// fromRRs groups resource records into RRsets by owner name and type,
+// keeping the order in which each RRset first appears.
+func fromRRs(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	index := make(map[string]*rrset)
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		t := dns.TypeToString[h.Rrtype]
+		key := strings.ToLower(h.Name) + " " + t
+
+		s, ok := index[key]
+		if !ok {
+			s = &rrset{Name: h.Name, Type: t, TTL: int64(h.Ttl)}
+			index[key] = s
+			sets = append(sets, s)
+		}
+		s.Rrdatas = append(s.Rrdatas, strings.TrimPrefix(rr.String(), h.String()))
+	}
+
+	return sets
+}
+
+// managedTypes are the record types cdh reads and changes: the TLSA records
+// and the TXT records of the ownership registry.
+var managedTypes = []string{"TLSA", "TXT"}
+
+// managedType reports whether records of type t are managed by cdh.
+func managedType(t string) bool {
+	for _, m := range managedTypes {
+		if strings.EqualFold(m, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// changeset holds the resource record sets to delete and to add in a single
+// change. Deletions must match the existing RRsets exactly.
+type changeset struct {
+	Deletions []*rrset `json:"deletions"`
+	Additions []*rrset `json:"additions"`
+}
+
+// Empty reports whether the changeset has nothing to apply.
+func (c *changeset) Empty() bool {
+	return len(c.Deletions) == 0 && len(c.Additions) == 0
+}
+
+// Replace adds the change from old, which may be nil, to r, unless both hold
+// the same records.
+func (c *changeset) Replace(old, r *rrset) {
+	if old != nil {
+		if sameRRData(r.Type, old.Rrdatas, r.Rrdatas) {
+			return
+		}
+		c.Deletions = append(c.Deletions, old)
+	}
+	c.Additions = append(c.Additions, r)
+}
+
+// sameRRData reports whether a and b hold the same records of type t in any
+// order. TLSA records are compared after parsing, so case and spacing of the
+// data do not matter.
+func sameRRData(t string, a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	norm := func(rrdatas []string) []string {
+		s := make([]string, 0, len(rrdatas))
+		for _, rd := range rrdatas {
+			if r, err := parseRRData(rd); err == nil && t == "TLSA" {
+				rd = r.String()
+			}
+			s = append(s, rd)
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	x, y := norm(a), norm(b)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// provider is a DNS backend hosting the TLSA records of a zone.
+type provider interface {
+	// List returns the TLSA and TXT resource record sets in the zone.
+	List(ctx context.Context) ([]*rrset, error)
+	// Apply submits the changeset and returns an identifier for Wait.
+	Apply(ctx context.Context, c *changeset) (string, error)
+	// Wait blocks until the change identified by id has been applied.
+	Wait(ctx context.Context, id string) error
+}
+
+// options holds provider-specific settings given as repeated -o name=value
+// flags.
+type options map[string]string
+
+// String returns the options in name=value form.
+func (o options) String() string {
+	pairs := make([]string, 0, len(o))
+	for k, v := range o {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses a name=value pair and stores it.
+func (o options) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("option %q is not in name=value form", v)
+	}
+	o[k] = val
+	return nil
+}
+
+// Require returns the value of a mandatory option.
+func (o options) Require(name string) (string, error) {
+	v, ok := o[name]
+	if !ok || v == "" {
+		return "", fmt.Errorf("missing option %q", name)
+	}
+	return v, nil
+}
+
+// providerConfig holds the settings passed to a provider on creation.
+type providerConfig struct {
+	Zone    string
+	KeyFile string
+	Options options
+}
+
+// providerFactory creates a provider from its configuration.
+type providerFactory func(ctx context.Context, cfg providerConfig) (provider, error)
+
+// providers maps the names accepted by the -p flag to their factories.
+var providers = map[string]providerFactory{
+	"cloudflare": newCloudflareProvider,
+	"desec":      newDESECProvider,
+	"exec":       newExecProvider,
+	"gcloud":     newGCloudProvider,
+	"powerdns":   newPowerDNSProvider,
+	"rfc2136":    newRFC2136Provider,
+	"route53":    newRoute53Provider,
+	"zonefile":   newZonefileProvider,
+}
+
+// providerNames returns the sorted names of the registered providers.
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for n := range providers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newProvider creates the provider registered under name.
+func newProvider(ctx context.Context, name string, cfg providerConfig) (provider, error) {
+	f, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf(
+			"unknown provider %q, expected one of %s",
+			name,
+			strings.Join(providerNames(), ", "),
+		)
+	}
+	return f(ctx, cfg)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProviderUnknown(t *testing.T) {
+	p, err := newProvider(context.Background(), "nope", providerConfig{})
+
+	assert.Nil(t, p, "Expected nil provider")
+	assert.ErrorContains(t, err, "gcloud", "Expected known providers to be listed")
+}
+
+func TestChangesetEmpty(t *testing.T) {
+	assert.True(t, (&changeset{}).Empty(), "Expected empty changeset")
+	assert.False(t, (&changeset{Additions: []*rrset{{}}}).Empty(), "Expected non-empty changeset")
+}
+
+func TestChangesetReplace(t *testing.T) {
+	old := &rrset{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 ABCDEF", "2 1 1 123456"}}
+	c := &changeset{}
+
+	c.Replace(old, &rrset{Name: old.Name, Type: "TLSA", TTL: 300, Rrdatas: []string{"2 1 1 123456", "3 1 1 abcdef"}})
+	assert.True(t, c.Empty(), "Expected the same records to be left alone")
+
+	r := &rrset{Name: old.Name, Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 abcdef"}}
+	c.Replace(old, r)
+	assert.Equal(t, &changeset{Deletions: []*rrset{old}, Additions: []*rrset{r}}, c, "Expected RRset to be replaced")
+
+	c = &changeset{}
+	c.Replace(nil, r)
+	assert.Equal(t, &changeset{Additions: []*rrset{r}}, c, "Expected new RRset to be added")
+}
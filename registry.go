@@ -0,0 +1,243 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// registryEntry records that a lineage published a TLSA record. The
+// registry of a TLSA RRset is kept as one TXT string per entry.
+type registryEntry struct {
+	Lineage string
+	Record  string
+	Added   time.Time
+}
+
+// registryTag starts every TXT string written by cdh.
+const registryTag = "cdh"
+
+// String returns the entry as stored in the TXT record, such as
+// "cdh lineage=example.com tlsa=3-1-1:abcdef added=2024-01-02T03:04:05Z".
+func (e registryEntry) String() string {
+	return fmt.Sprintf("%s lineage=%s tlsa=%s added=%s",
+		registryTag, e.Lineage, e.Record, e.Added.UTC().Format(time.RFC3339))
+}
+
+// parseRegistryEntry parses a TXT string written by cdh.
+func parseRegistryEntry(s string) (registryEntry, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 || f[0] != registryTag {
+		return registryEntry{}, fmt.Errorf("%q is not a registry entry", s)
+	}
+
+	var e registryEntry
+	for _, kv := range f[1:] {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "lineage":
+			e.Lineage = v
+		case "tlsa":
+			e.Record = strings.ToLower(v)
+		case "added":
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return registryEntry{}, fmt.Errorf("registry entry %q: %w", s, err)
+			}
+			e.Added = t
+		}
+	}
+	if e.Lineage == "" || e.Record == "" {
+		return registryEntry{}, fmt.Errorf("registry entry %q has no lineage or record", s)
+	}
+	return e, nil
+}
+
+// registryID identifies r in the registry by its parameters and data. The
+// data of exact matches is replaced by its SHA-256 digest to keep the entry
+// short.
+func registryID(r tlsaRecord) string {
+	data := r.Data
+	if r.MatchingType == 0 {
+		b, _ := hex.DecodeString(data)
+		h := sha256.Sum256(b)
+		data = hex.EncodeToString(h[:])
+	}
+	return fmt.Sprintf("%d-%d-%d:%s", r.Usage, r.Selector, r.MatchingType, data)
+}
+
+// registryOwner returns the owner name of the registry of the TLSA RRset
+// at name: name itself, or a sibling whose first label starts with prefix.
+func registryOwner(name, prefix string) string {
+	return prefix + dns.Fqdn(name)
+}
+
+// tlsaOwner returns the owner name of the TLSA RRset whose registry is at
+// name, or false if name cannot hold a registry.
+func tlsaOwner(name, prefix string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix)) {
+		return "", false
+	}
+	return name[len(prefix):], true
+}
+
+// txtStrings returns the text of TXT record data in presentation format.
+func txtStrings(rdata string) (string, error) {
+	rr, err := dns.NewRR(". TXT " + rdata)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(rr.(*dns.TXT).Txt, ""), nil
+}
+
+// registryRRData returns the TLSA record data of an RRset and the TXT record
+// data of its registry. old, which may be nil, and reg are the current
+// RRset and registry. The records of t are published and registered to the
+// lineage. A record of old is retired only if the registry lists it for the
+// lineage and for no other one, it is not pinned and it is not held for a
+// rollover. Anything else, including TXT strings not written by cdh, is
+// kept.
+func registryRRData(old *rrset, reg []string, t *tlsa, o changeOptions) (rrdatas, txt []string) {
+	mine := make(map[string]registryEntry)
+	theirs := make(map[string]bool)
+	var kept []string
+	for _, rd := range reg {
+		s, err := txtStrings(rd)
+		if err != nil {
+			kept = append(kept, rd)
+			continue
+		}
+		e, err := parseRegistryEntry(s)
+		switch {
+		case err != nil:
+			kept = append(kept, rd)
+		case e.Lineage == o.Lineage:
+			mine[e.Record] = e
+		default:
+			theirs[e.Record] = true
+			txt = append(txt, rd)
+		}
+	}
+
+	rrdatas = t.MakeRRData()
+	seen := make(map[string]bool)
+	var entries []string
+	for _, rec := range t.Records {
+		if rec.Data == "" || seen[rec.String()] {
+			continue
+		}
+		seen[rec.String()] = true
+
+		e, ok := mine[registryID(rec)]
+		if !ok {
+			e = registryEntry{Lineage: o.Lineage, Record: registryID(rec), Added: o.Now}
+		}
+		entries = append(entries, fmt.Sprintf("%q", e.String()))
+	}
+
+	var rds []string
+	if old != nil {
+		rds = old.Rrdatas
+	}
+	for _, rd := range rds {
+		r, err := parseRRData(rd)
+		if err != nil {
+			rrdatas = append(rrdatas, rd)
+			continue
+		}
+		if seen[r.String()] {
+			continue
+		}
+		id := registryID(r)
+		if e, ok := mine[id]; ok && !theirs[id] && !o.Pins.Pinned(r) {
+			if !o.Rollover.Hold(old, rd) {
+				continue
+			}
+			entries = append(entries, fmt.Sprintf("%q", e.String()))
+		}
+		seen[r.String()] = true
+		rrdatas = append(rrdatas, rd)
+	}
+
+	return rrdatas, append(append(entries, txt...), kept...)
+}
+
+// retireLineage adds the changes that retire the records of the lineage at
+// the owner names it no longer covers to cset. registry holds the TXT RRsets
+// not already changed and tlsas all TLSA RRsets, both by owner name.
+func retireLineage(cset *changeset, rR []*rrset, tlsas, registry map[string]*rrset, o changeOptions) {
+	for _, reg := range rR {
+		if reg.Type != "TXT" || registry[strings.ToLower(reg.Name)] != reg {
+			continue
+		}
+		owner, ok := tlsaOwner(reg.Name, o.RegistryPrefix)
+		if !ok {
+			continue
+		}
+
+		r := tlsas[strings.ToLower(owner)]
+
+		// Without records to publish, only the entries of the lineage go.
+		rrdatas, txt := registryRRData(r, reg.Rrdatas, &tlsa{}, o)
+		if len(txt) == len(reg.Rrdatas) {
+			continue
+		}
+
+		if r != nil && len(rrdatas) != len(r.Rrdatas) {
+			cset.Deletions = append(cset.Deletions, r)
+			if len(rrdatas) > 0 {
+				cset.Additions = append(cset.Additions, &rrset{Name: r.Name, Type: r.Type, TTL: r.TTL, Rrdatas: rrdatas})
+			}
+		}
+		cset.Deletions = append(cset.Deletions, reg)
+		if len(txt) > 0 {
+			cset.Additions = append(cset.Additions, &rrset{Name: reg.Name, Type: reg.Type, TTL: reg.TTL, Rrdatas: txt})
+		}
+	}
+}
+
+// dropEntries adds the change removing the entries of the records with the
+// given registry IDs from reg, which may be nil, to cset.
+func dropEntries(cset *changeset, reg *rrset, ids map[string]bool) {
+	if reg == nil {
+		return
+	}
+
+	var txt []string
+	for _, rd := range reg.Rrdatas {
+		if s, err := txtStrings(rd); err == nil {
+			if e, err := parseRegistryEntry(s); err == nil && ids[e.Record] {
+				continue
+			}
+		}
+		txt = append(txt, rd)
+	}
+	if len(txt) == len(reg.Rrdatas) {
+		return
+	}
+
+	cset.Deletions = append(cset.Deletions, reg)
+	if len(txt) > 0 {
+		cset.Additions = append(cset.Additions, &rrset{Name: reg.Name, Type: reg.Type, TTL: reg.TTL, Rrdatas: txt})
+	}
+}
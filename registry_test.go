@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryEntry(t *testing.T) {
+	e := registryEntry{
+		Lineage: "example.com",
+		Record:  "3-1-1:abcdef",
+		Added:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	assert.Equal(t, "cdh lineage=example.com tlsa=3-1-1:abcdef added=2024-01-02T03:04:05Z", e.String(), "Expected entry format")
+
+	got, err := parseRegistryEntry(e.String())
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, e, got, "Expected entry to round trip")
+
+	for _, s := range []string{"", "v=spf1 -all", "cdh tlsa=3-1-1:abcdef", "cdh lineage=a tlsa=3-1-1:ab added=yesterday"} {
+		_, err := parseRegistryEntry(s)
+		assert.Error(t, err, "Expected %q to be refused", s)
+	}
+}
+
+func TestRegistryID(t *testing.T) {
+	assert.Equal(t, "3-1-1:abcdef", registryID(tlsaRecord{tlsaParams{3, 1, 1}, "abcdef"}), "Expected digest as is")
+	assert.Equal(t,
+		"3-1-0:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		registryID(tlsaRecord{tlsaParams{3, 1, 0}, ""}),
+		"Expected full data to be hashed")
+}
+
+func TestRegistryRRData(t *testing.T) {
+	then := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := then.Add(90 * 24 * time.Hour)
+	o := changeOptions{Lineage: "example.com", Now: now}
+	d := testTLSA("abcdef", "123456")
+
+	entry := func(lineage, record string, added time.Time) string {
+		return `"` + registryEntry{lineage, record, added}.String() + `"`
+	}
+
+	old := []string{
+		"3 1 1 000000",     // previously published by this lineage
+		"2 1 1 123456",     // still published
+		"3 1 1 " + testPin, // backup key added by hand
+		"3 1 1 111111",     // published by another lineage
+	}
+	reg := []string{
+		entry("example.com", "3-1-1:000000", then),
+		entry("example.com", "2-1-1:123456", then),
+		entry("other", "3-1-1:111111", then),
+		`"hand-written note"`,
+	}
+
+	rrdatas, txt := registryRRData(&rrset{Rrdatas: old}, reg, d, o)
+
+	assert.Equal(t, []string{
+		"3 1 1 abcdef",
+		"2 1 1 123456",
+		"3 1 1 " + testPin,
+		"3 1 1 111111",
+	}, rrdatas, "Expected only the retired record of the lineage to go")
+	assert.Equal(t, []string{
+		entry("example.com", "3-1-1:abcdef", now),
+		entry("example.com", "2-1-1:123456", then),
+		entry("other", "3-1-1:111111", then),
+		`"hand-written note"`,
+	}, txt, "Expected registry of the published records")
+
+	rrdatas, _ = registryRRData(&rrset{Rrdatas: old}, nil, d, o)
+	assert.Equal(t, append(d.MakeRRData(), old[0], old[2], old[3]), rrdatas, "Expected unregistered records to be kept")
+}
+
+func TestTLSAOwner(t *testing.T) {
+	owner, ok := tlsaOwner("CDH-_443._tcp.example.com.", "cdh-")
+	assert.True(t, ok, "Expected prefix to match")
+	assert.Equal(t, "_443._tcp.example.com.", owner, "Expected prefix to be removed")
+
+	_, ok = tlsaOwner("_443._tcp.example.com.", "cdh-")
+	assert.False(t, ok, "Expected name without prefix to be refused")
+}
@@ -0,0 +1,295 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// revokeTarget is a compromised key given as an SPKI SHA-256 digest, a
+// certificate, or a private key or certificate signing request.
+type revokeTarget struct {
+	Hash string
+	SPKI []byte
+	Cert *x509.Certificate
+}
+
+// revokedKeys is the deny-list of the SPKI SHA-256 digests, in hex, of the
+// keys revoked with the revoke subcommand. Their records are not published
+// again.
+type revokedKeys map[string]bool
+
+// Key reports whether the public key spki is revoked.
+func (k revokedKeys) Key(spki []byte) bool {
+	h := sha256.Sum256(spki)
+	return k[hex.EncodeToString(h[:])]
+}
+
+// Cert reports whether the key of c is revoked.
+func (k revokedKeys) Cert(c *x509.Certificate) bool {
+	return k.Key(c.RawSubjectPublicKeyInfo)
+}
+
+// Record reports whether r matches the public key of a revoked key. Records
+// of the whole certificate or of a SHA-512 digest cannot be told without
+// the key.
+func (k revokedKeys) Record(r tlsaRecord) bool {
+	if r.Selector != 1 {
+		return false
+	}
+	switch r.MatchingType {
+	case 0:
+		b, err := hex.DecodeString(r.Data)
+		return err == nil && k.Key(b)
+	case 1:
+		return k[strings.ToLower(r.Data)]
+	}
+	return false
+}
+
+// parseRevokeTarget parses a hex encoded SPKI SHA-256 digest or reads the
+// PEM file named by arg.
+func parseRevokeTarget(arg string) (*revokeTarget, error) {
+	if b, err := hex.DecodeString(arg); err == nil && len(b) == sha256.Size {
+		return &revokeTarget{Hash: strings.ToLower(arg)}, nil
+	}
+
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &revokeTarget{}
+	if b, _ := pem.Decode(data); b != nil && b.Type == "CERTIFICATE" {
+		if t.Cert, err = x509.ParseCertificate(b.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", arg, err)
+		}
+		t.SPKI = t.Cert.RawSubjectPublicKeyInfo
+	} else if t.SPKI, _, err = parseKey(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", arg, err)
+	}
+
+	h := sha256.Sum256(t.SPKI)
+	t.Hash = hex.EncodeToString(h[:])
+	return t, nil
+}
+
+// Match reports whether r is derived from the key of the target. Records
+// matching the whole certificate can only be matched if it was given.
+func (t *revokeTarget) Match(r tlsaRecord) bool {
+	if r.Selector == 0 {
+		if t.Cert == nil {
+			return false
+		}
+		data, err := dns.CertificateToDANE(r.Selector, r.MatchingType, t.Cert)
+		return err == nil && strings.EqualFold(data, r.Data)
+	}
+
+	var data string
+	switch {
+	case r.MatchingType == 1:
+		data = t.Hash
+	case t.SPKI == nil:
+		return false
+	case r.MatchingType == 0:
+		data = hex.EncodeToString(t.SPKI)
+	case r.MatchingType == 2:
+		h := sha512.Sum512(t.SPKI)
+		data = hex.EncodeToString(h[:])
+	}
+	return strings.EqualFold(data, r.Data)
+}
+
+// revokeChange returns the changeset that removes the records of every
+// TLSA RRset in rR that match one of targets, along with their registry
+// entries, and drops them from the rollover state. It refuses to leave an
+// RRset empty unless force is set, in which case the RRset is deleted.
+func revokeChange(rR []*rrset, targets []*revokeTarget, o changeOptions, force bool) (*changeset, error) {
+	cset := changeset{}
+
+	registry := make(map[string]*rrset)
+	for _, r := range rR {
+		if r.Type == "TXT" {
+			registry[strings.ToLower(r.Name)] = r
+		}
+	}
+
+	var empty []string
+	for _, r := range rR {
+		if r.Type != "TLSA" {
+			continue
+		}
+
+		var keep, gone []string
+		removed := make(map[string]bool)
+	records:
+		for _, rd := range r.Rrdatas {
+			rec, err := parseRRData(rd)
+			if err == nil {
+				for _, t := range targets {
+					if t.Match(rec) {
+						log.Printf("revoking %s %s", r.Name, rd)
+						removed[registryID(rec)] = true
+						gone = append(gone, rd)
+						continue records
+					}
+				}
+			}
+			keep = append(keep, rd)
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		o.Rollover.Forget(r.Name, gone)
+		if len(keep) == 0 {
+			empty = append(empty, r.Name)
+		}
+
+		cset.Deletions = append(cset.Deletions, r)
+		if len(keep) > 0 {
+			cset.Additions = append(cset.Additions, &rrset{Name: r.Name, Type: r.Type, TTL: r.TTL, Rrdatas: keep})
+		}
+		if o.Registry {
+			dropEntries(&cset, registry[strings.ToLower(registryOwner(r.Name, o.RegistryPrefix))], removed)
+		}
+	}
+
+	if len(empty) > 0 && !force {
+		return nil, fmt.Errorf("revoking would leave %s without records, publish the replacement first or force it", strings.Join(empty, ", "))
+	}
+
+	return &cset, nil
+}
+
+// revoke removes the records of compromised keys from every TLSA RRset of
+// the zone at once, and keeps the keys in the state file so they are not
+// published again. It fails if other zones of the state file may still
+// publish them.
+func revoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	registerFlags(fs)
+	force := fs.Bool("F", false, "delete RRsets left without records")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: cdh revoke [flags] [-F] hash|file..., run once for every zone that publishes the key")
+	}
+	if rolloverFile == "" {
+		return errors.New("revoke needs the rollover state file given with -f to keep the key from being published again")
+	}
+
+	var targets []*revokeTarget
+	for _, arg := range fs.Args() {
+		t, err := parseRevokeTarget(arg)
+		if err != nil {
+			return err
+		}
+		if t.Cert == nil {
+			log.Printf("records of %s matching the whole certificate need the certificate to be found", arg)
+		}
+		targets = append(targets, t)
+	}
+
+	ctx := context.Background()
+	changeOpts.Registry = changeOpts.Registry || changeOpts.RegistryPrefix != ""
+	if err := loadState(); err != nil {
+		return err
+	}
+	s := changeOpts.Rollover
+
+	p, err := newProvider(ctx, providerName, providerConfig{
+		Zone:    zone,
+		KeyFile: keyPath,
+		Options: providerOpts,
+	})
+	if err != nil {
+		return err
+	}
+
+	records, err := p.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	cset, err := revokeChange(records, targets, changeOpts, *force)
+	if err != nil {
+		return err
+	}
+
+	// The deny-list is saved first, so the key stays out even if the
+	// change fails.
+	for _, t := range targets {
+		s.Revoke(t.Hash)
+	}
+	if err = s.Save(); err != nil {
+		return err
+	}
+
+	if cset.Empty() {
+		fmt.Println("unchanged")
+		return revokePending(s, targets)
+	}
+
+	id, err := p.Apply(ctx, cset)
+	if err != nil {
+		return err
+	}
+
+	if err = p.Wait(ctx, id); err != nil {
+		return err
+	}
+
+	fmt.Println("done")
+	return revokePending(s, targets)
+}
+
+// revokePending returns an error naming the other zones of the state file
+// the keys of targets were not removed from, as revoke only changes the zone
+// it is run for.
+func revokePending(s *rollover, targets []*revokeTarget) error {
+	pending := make(map[string]bool)
+	for _, t := range targets {
+		for _, z := range s.RevokePending(t.Hash) {
+			pending[z] = true
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	zones := make([]string, 0, len(pending))
+	for z := range pending {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return fmt.Errorf("the key is still to be revoked in %s, run revoke for those zones too", strings.Join(zones, ", "))
+}
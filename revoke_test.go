@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRevokeTarget(t *testing.T) {
+	c := newTestChain(t)
+	dir := t.TempDir()
+
+	target, err := parseRevokeTarget(strings.ToUpper(spkiHash(c.Leaf.Cert)))
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &revokeTarget{Hash: spkiHash(c.Leaf.Cert)}, target, "Expected digest")
+
+	cert := filepath.Join(dir, "cert.pem")
+	assert.NoError(t, os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Leaf.Cert.Raw}), 0o644), "Expected no error")
+	target, err = parseRevokeTarget(cert)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, spkiHash(c.Leaf.Cert), target.Hash, "Expected digest of the certificate key")
+	assert.Equal(t, c.Leaf.Cert, target.Cert, "Expected certificate")
+
+	der, err := x509.MarshalPKCS8PrivateKey(c.Leaf.Key)
+	assert.NoError(t, err, "Expected no error")
+	key := filepath.Join(dir, "privkey.pem")
+	assert.NoError(t, os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600), "Expected no error")
+	target, err = parseRevokeTarget(key)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, spkiHash(c.Leaf.Cert), target.Hash, "Expected digest of the private key")
+	assert.Nil(t, target.Cert, "Expected no certificate")
+
+	_, err = parseRevokeTarget(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err, "Expected missing file to be refused")
+}
+
+func TestRevokeTargetMatch(t *testing.T) {
+	c := newTestChain(t)
+	spki := c.Leaf.Cert.RawSubjectPublicKeyInfo
+	h := sha512.Sum512(spki)
+	full := &revokeTarget{Hash: spkiHash(c.Leaf.Cert), SPKI: spki, Cert: c.Leaf.Cert}
+	hash := &revokeTarget{Hash: spkiHash(c.Leaf.Cert)}
+
+	for _, r := range []tlsaRecord{
+		{tlsaParams{3, 1, 1}, spkiHash(c.Leaf.Cert)},
+		{tlsaParams{1, 1, 2}, hex.EncodeToString(h[:])},
+		{tlsaParams{3, 1, 0}, hex.EncodeToString(spki)},
+		{tlsaParams{3, 0, 0}, hex.EncodeToString(c.Leaf.Cert.Raw)},
+	} {
+		assert.True(t, full.Match(r), "Expected %s to match the certificate", r.tlsaParams)
+	}
+
+	assert.True(t, hash.Match(tlsaRecord{tlsaParams{3, 1, 1}, strings.ToUpper(spkiHash(c.Leaf.Cert))}), "Expected digest to match")
+	assert.False(t, hash.Match(tlsaRecord{tlsaParams{3, 1, 0}, hex.EncodeToString(spki)}), "Expected digest not to match full data")
+	assert.False(t, full.Match(tlsaRecord{tlsaParams{3, 1, 1}, spkiHash(c.Inter.Cert)}), "Expected other key not to match")
+}
+
+func TestRevokeChange(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	target := &revokeTarget{Hash: "aaaa"}
+	existing := []*rrset{
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 AAAA", "3 1 1 " + testPin}},
+		{Name: "_443._tcp.example.com.", Type: "TXT", TTL: 300, Rrdatas: []string{
+			`"` + registryEntry{"example.com", "3-1-1:aaaa", now}.String() + `"`,
+		}},
+		{Name: "_25._tcp.mail.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 aaaa", "2 1 1 cccc"}},
+		{Name: "_443._tcp.www.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 bbbb"}},
+	}
+
+	cset, err := revokeChange(existing, []*revokeTarget{target}, changeOptions{Registry: true}, false)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, existing[:3], cset.Deletions, "Expected every RRset with the key to change")
+	assert.Equal(t, []*rrset{
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 " + testPin}},
+		{Name: "_25._tcp.mail.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"2 1 1 cccc"}},
+	}, cset.Additions, "Expected replacement records to stay")
+
+	_, err = revokeChange(existing, []*revokeTarget{target, {Hash: testPin}}, changeOptions{}, false)
+	assert.ErrorContains(t, err, "leave _443._tcp.example.com. without records", "Expected empty RRset to be refused")
+
+	cset, err = revokeChange(existing, []*revokeTarget{target, {Hash: testPin}}, changeOptions{}, true)
+	assert.NoError(t, err, "Expected no error")
+	assert.Len(t, cset.Additions, 1, "Expected emptied RRset to be deleted when forced")
+}
+
+func TestRevoke(t *testing.T) {
+	old := strings.Repeat("ab", 32)
+	f := filepath.Join(t.TempDir(), "example.com.zone")
+	assert.NoError(t, os.WriteFile(f, []byte(`$TTL 1h
+@	IN	SOA	ns1 hostmaster 1 7200 3600 1209600 3600
+_443._tcp	300	IN	TLSA	3 1 1 `+old+`
+	300	IN	TLSA	3 1 1 `+testPin+`
+_25._tcp.mail	300	IN	TLSA	3 1 1 `+old+`
+`), 0o640), "Expected no error")
+	state := filepath.Join(t.TempDir(), "rollover.json")
+	t.Cleanup(func() {
+		providerOpts = options{}
+		rolloverFile = ""
+		changeOpts = changeOptions{}
+	})
+
+	args := []string{"-p", "zonefile", "-z", "example.com.", "-o", "file=" + f, old}
+	assert.ErrorContains(t, revoke(args), "-f", "Expected the state file to be required")
+
+	args = append([]string{"-f", state}, args...)
+	assert.ErrorContains(t, revoke(args), "_25._tcp.mail.example.com.", "Expected empty RRset to be refused")
+
+	assert.NoError(t, revoke(append([]string{"-F"}, args...)), "Expected no error")
+
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.NotContains(t, string(data), old, "Expected revoked key to be removed")
+	assert.Contains(t, string(data), testPin, "Expected backup key to be kept")
+}
+
+func TestRevokePending(t *testing.T) {
+	old := strings.Repeat("ab", 32)
+	zones := t.TempDir()
+	for _, z := range []string{"example.com.", "example.net."} {
+		assert.NoError(t, os.WriteFile(filepath.Join(zones, z+"zone"), []byte(`$TTL 1h
+@	IN	SOA	ns1 hostmaster 1 7200 3600 1209600 3600
+_443._tcp	300	IN	TLSA	3 1 1 `+old+`
+	300	IN	TLSA	3 1 1 `+testPin+`
+`), 0o640), "Expected no error")
+	}
+	state := filepath.Join(t.TempDir(), "rollover.json")
+	assert.NoError(t, os.WriteFile(state, []byte(`{"version": 1, "retired": [
+		{"zone": "example.net.", "owner": "_443._tcp.example.net.", "rdata": "3 1 1 0000", "until": "2000-01-01T00:00:00Z"}
+	]}`), 0o600), "Expected no error")
+	t.Cleanup(func() {
+		providerOpts = options{}
+		rolloverFile = ""
+		changeOpts = changeOptions{}
+	})
+
+	run := func(z string) error {
+		return revoke([]string{"-p", "zonefile", "-z", z, "-o", "file=" + filepath.Join(zones, z+"zone"), "-f", state, old})
+	}
+
+	assert.ErrorContains(t, run("example.com."), "still to be revoked in example.net.", "Expected the other zone to be reported")
+	data, err := os.ReadFile(filepath.Join(zones, "example.com.zone"))
+	assert.NoError(t, err, "Expected no error")
+	assert.NotContains(t, string(data), old, "Expected revoked key to be removed from the zone")
+
+	assert.NoError(t, run("example.net."), "Expected no zone to be left")
+	data, err = os.ReadFile(state)
+	assert.NoError(t, err, "Expected no error")
+	assert.Contains(t, string(data), `"example.com.",`, "Expected the zones to be kept in the state")
+}
+
+func TestRevokeUpdate(t *testing.T) {
+	c := newTestChain(t)
+	old := newTestCert(t, "example.com", false, c.Inter, nil)
+	live := writeArchive(t, c.Inter.Cert, old.Cert, c.Leaf.Cert)
+	f := writeTestZone(t)
+	state := filepath.Join(t.TempDir(), "rollover.json")
+	t.Cleanup(func() {
+		providerName, zone, providerOpts = "", "", options{}
+		rolloverFile = ""
+		certOpts, changeOpts = certOptions{}, changeOptions{}
+	})
+
+	publish := func() {
+		providerName, zone, providerOpts = "zonefile", "example.com.", options{"file": f}
+		rolloverFile, certOpts.Grace = state, 2*time.Hour
+		assert.NoError(t, loadState(), "Expected no error")
+		d, err := readCert(live, certOpts)
+		assert.NoError(t, err, "Expected no error")
+		assert.NoError(t, update(context.Background(), live, d), "Expected no error")
+	}
+
+	publish()
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.Contains(t, string(data), spkiHash(old.Cert), "Expected previous key within the grace window")
+
+	err = revoke([]string{"-p", "zonefile", "-z", "example.com.", "-o", "file=" + f, "-f", state, spkiHash(old.Cert)})
+	assert.NoError(t, err, "Expected no error")
+
+	// The next update does not bring the revoked key back.
+	publish()
+	data, err = os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.NotContains(t, string(data), spkiHash(old.Cert), "Expected revoked key to stay out")
+	assert.Contains(t, string(data), spkiHash(c.Leaf.Cert), "Expected current key to be published")
+}
+
+func TestRolloverRevoke(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	next := []byte("next key")
+	h := sha256.Sum256(next)
+	hash := hex.EncodeToString(h[:])
+	r := &rrset{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300}
+
+	s, err := loadRollover(filepath.Join(t.TempDir(), "rollover.json"), "example.com", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	s.Stage("example.com", next, []byte("current key"))
+	assert.True(t, s.Hold(r, "3 1 1 "+hash), "Expected record to be held")
+
+	s.Revoke(hash)
+
+	assert.Empty(t, s.staged, "Expected revoked key to be unstaged")
+	assert.False(t, s.Hold(r, "3 1 1 "+hash), "Expected revoked key not to be held")
+	assert.False(t, s.Hold(r, "3 1 0 "+hex.EncodeToString(next)), "Expected revoked key not to be held")
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected other records to be held")
+}
@@ -0,0 +1,239 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigAlgorithms maps BIND algorithm names to their TSIG algorithm names.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKey is a TSIG key read from a BIND key file.
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+var (
+	keyNameRe   = regexp.MustCompile(`key\s+"?([^"\s{]+)"?\s*\{`)
+	algorithmRe = regexp.MustCompile(`algorithm\s+"?([^"\s;]+)"?\s*;`)
+	secretRe    = regexp.MustCompile(`secret\s+"([^"]+)"\s*;`)
+)
+
+// readTSIGKey parses a BIND-style key file as written by tsig-keygen.
+func readTSIGKey(f string) (*tsigKey, error) {
+	data, err := os.ReadFile(filepath.Clean(f))
+	if err != nil {
+		return nil, err
+	}
+
+	name := keyNameRe.FindSubmatch(data)
+	alg := algorithmRe.FindSubmatch(data)
+	secret := secretRe.FindSubmatch(data)
+	if name == nil || alg == nil || secret == nil {
+		return nil, fmt.Errorf("%s: not a BIND key file", f)
+	}
+
+	a, ok := tsigAlgorithms[strings.ToLower(string(alg[1]))]
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported TSIG algorithm %s", f, alg[1])
+	}
+
+	return &tsigKey{
+		Name:      dns.CanonicalName(string(name[1])),
+		Algorithm: a,
+		Secret:    string(secret[1]),
+	}, nil
+}
+
+// rfc2136Provider manages TLSA records with DNS UPDATE messages sent to the
+// primary server of a zone. Messages are authenticated with either a TSIG
+// key or a SIG(0) key.
+type rfc2136Provider struct {
+	server string
+	zone   string
+	key    *tsigKey
+	sig0   *sig0Key
+}
+
+// newRFC2136Provider creates a dynamic update provider. The zone is the apex
+// of the zone, the key file is a BIND TSIG key file or a K*.private SIG(0)
+// key file, and the server option is the address of the primary.
+func newRFC2136Provider(ctx context.Context, cfg providerConfig) (provider, error) {
+	server, err := cfg.Options.Require("server")
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	p := &rfc2136Provider{
+		server: server,
+		zone:   dns.Fqdn(cfg.Zone),
+	}
+
+	if filepath.Ext(cfg.KeyFile) == ".private" {
+		p.sig0, err = readSIG0Key(cfg.KeyFile)
+	} else {
+		p.key, err = readTSIGKey(cfg.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// sign adds a TSIG record to the message if a TSIG key is in use.
+func (p *rfc2136Provider) sign(m *dns.Msg) {
+	if p.key != nil {
+		m.SetTsig(p.key.Name, p.key.Algorithm, 300, time.Now().Unix())
+	}
+}
+
+// secrets returns the TSIG secrets for the miekg/dns client and transfer.
+func (p *rfc2136Provider) secrets() map[string]string {
+	if p.key == nil {
+		return nil
+	}
+	return map[string]string{p.key.Name: p.key.Secret}
+}
+
+// List transfers the zone and returns its TLSA and TXT resource record sets.
+// With SIG(0) the transfer is not signed and the primary must allow it by
+// address.
+func (p *rfc2136Provider) List(ctx context.Context) ([]*rrset, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(p.zone)
+	p.sign(m)
+
+	t := &dns.Transfer{TsigSecret: p.secrets()}
+	env, err := t.In(m, p.server)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		for _, rr := range e.RR {
+			if managedType(dns.TypeToString[rr.Header().Rrtype]) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+
+	return fromRRs(rrs), nil
+}
+
+// Apply sends the changeset as a single DNS UPDATE message. The update is
+// applied atomically by the server, so the returned ID is the message ID.
+func (p *rfc2136Provider) Apply(ctx context.Context, c *changeset) (string, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+
+	for _, r := range c.Deletions {
+		m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+			Name:   r.Name,
+			Rrtype: dns.StringToType[r.Type],
+		}}})
+	}
+	for _, r := range c.Additions {
+		rrs, err := r.RRs()
+		if err != nil {
+			return "", err
+		}
+		m.Insert(rrs)
+	}
+
+	if err := p.exchange(ctx, m); err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(int(m.Id)), nil
+}
+
+// exchange signs and sends the UPDATE message and checks the response code.
+func (p *rfc2136Provider) exchange(ctx context.Context, m *dns.Msg) error {
+	var r *dns.Msg
+	var err error
+
+	c := &dns.Client{Net: "tcp", TsigSecret: p.secrets()}
+	if p.sig0 != nil {
+		r, err = p.exchangeSIG0(ctx, c, m)
+	} else {
+		p.sign(m)
+		r, _, err = c.ExchangeContext(ctx, m, p.server)
+	}
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of %s failed: %s", p.zone, dns.RcodeToString[r.Rcode])
+	}
+
+	return nil
+}
+
+// exchangeSIG0 sends the message signed with SIG(0). The signature is added
+// to the wire format, so the message is written without repacking.
+func (p *rfc2136Provider) exchangeSIG0(ctx context.Context, c *dns.Client, m *dns.Msg) (*dns.Msg, error) {
+	buf, err := p.sig0.Sign(m)
+	if err != nil {
+		return nil, err
+	}
+
+	co, err := c.DialContext(ctx, p.server)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := co.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := co.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return co.ReadMsg()
+}
+
+// Wait returns immediately as DNS UPDATE is synchronous.
+func (p *rfc2136Provider) Wait(ctx context.Context, id string) error {
+	return nil
+}
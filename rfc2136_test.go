@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2U="
+
+const testKeyFile = `key "cdh-key" {
+	algorithm hmac-sha256;
+	secret "` + testTSIGSecret + `";
+};
+`
+
+// testPrimary is a stand-in for a primary server accepting AXFR and UPDATE.
+// Updates must be signed with TSIG, or with SIG(0) by sig0 if it is set.
+type testPrimary struct {
+	mu   sync.Mutex
+	zone []dns.RR
+	addr string
+	sig0 *dns.KEY
+	raw  []byte
+}
+
+// captureReader records the wire format of the last message for SIG(0).
+type captureReader struct {
+	dns.Reader
+	s *testPrimary
+}
+
+func (c captureReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	b, err := c.Reader.ReadTCP(conn, timeout)
+	c.s.mu.Lock()
+	c.s.raw = b
+	c.s.mu.Unlock()
+	return b, err
+}
+
+func (s *testPrimary) authorized(w dns.ResponseWriter, r *dns.Msg) bool {
+	if r.IsTsig() != nil {
+		return w.TsigStatus() == nil
+	}
+	if s.sig0 == nil {
+		return false
+	}
+	if r.Opcode == dns.OpcodeQuery {
+		return true
+	}
+	if len(r.Extra) == 0 {
+		return false
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return false
+	}
+	return sig.Verify(s.sig0, s.raw) == nil
+}
+
+func (s *testPrimary) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if !s.authorized(w, r) {
+		m.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(m)
+		return
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+		m.Answer = append(m.Answer, s.zone...)
+		m.Answer = append(m.Answer, s.zone[0])
+	case dns.OpcodeUpdate:
+		for _, rr := range r.Ns {
+			h := rr.Header()
+			switch h.Class {
+			case dns.ClassANY:
+				kept := s.zone[:0]
+				for _, z := range s.zone {
+					if z.Header().Name != h.Name || z.Header().Rrtype != h.Rrtype {
+						kept = append(kept, z)
+					}
+				}
+				s.zone = kept
+			default:
+				s.zone = append(s.zone, rr)
+			}
+		}
+	}
+
+	if t := r.IsTsig(); t != nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, int64(t.TimeSigned))
+	}
+	_ = w.WriteMsg(m)
+}
+
+func newTestPrimary(t *testing.T) *testPrimary {
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 3600")
+	ns, _ := dns.NewRR("example.com. 3600 IN NS ns1.example.com.")
+	old, _ := dns.NewRR("_443._tcp.example.com. 300 IN TLSA 3 1 1 0000")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err, "Expected no error")
+
+	s := &testPrimary{zone: []dns.RR{soa, ns, old}, addr: l.Addr().String()}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           s,
+		TsigSecret:        map[string]string{"cdh-key.": testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		DecorateReader: func(r dns.Reader) dns.Reader {
+			return captureReader{Reader: r, s: s}
+		},
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return s
+}
+
+func TestReadTSIGKey(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "cdh.key")
+	assert.NoError(t, os.WriteFile(f, []byte(testKeyFile), 0o600), "Expected no error")
+
+	k, err := readTSIGKey(f)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &tsigKey{
+		Name:      "cdh-key.",
+		Algorithm: dns.HmacSHA256,
+		Secret:    testTSIGSecret,
+	}, k, "Expected key to match")
+}
+
+func TestReadTSIGKeyUnsupported(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "cdh.key")
+	data := `key "k" { algorithm hmac-md5; secret "AAAA"; };`
+	assert.NoError(t, os.WriteFile(f, []byte(data), 0o600), "Expected no error")
+
+	_, err := readTSIGKey(f)
+
+	assert.ErrorContains(t, err, "unsupported", "Expected algorithm to be rejected")
+}
+
+func TestRFC2136(t *testing.T) {
+	s := newTestPrimary(t)
+
+	f := filepath.Join(t.TempDir(), "cdh.key")
+	assert.NoError(t, os.WriteFile(f, []byte(testKeyFile), 0o600), "Expected no error")
+
+	p, err := newRFC2136Provider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		KeyFile: f,
+		Options: options{"server": s.addr},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 0000"},
+		},
+	}, rr, "Expected TLSA RRsets to be listed")
+
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.", "www.example.com.")
+	cset, _ := newChange(rr, d, changeOptions{})
+	id, err := p.Apply(context.Background(), cset)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.NoError(t, p.Wait(context.Background(), id), "Expected no error")
+
+	rr, err = p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef"},
+		},
+		{
+			Name:    "_443._tcp.www.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef"},
+		},
+	}, rr, "Expected TLSA RRsets to be replaced")
+}
@@ -0,0 +1,371 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rolloverVersion is the version of the rollover state file.
+const rolloverVersion = 1
+
+// rolloverEntry is a retired record kept published until the end of its
+// hold period.
+type rolloverEntry struct {
+	Zone  string    `json:"zone"`
+	Owner string    `json:"owner"`
+	Rdata string    `json:"rdata"`
+	Until time.Time `json:"until"`
+}
+
+// stagedKey is the next key of a lineage, published before certbot renews
+// with it. Current is the key of the certificate it was staged next to.
+type stagedKey struct {
+	Lineage string `json:"lineage"`
+	Key     []byte `json:"key"`
+	Current []byte `json:"current"`
+}
+
+// rolloverState is the JSON form of the rollover state file.
+type rolloverState struct {
+	Version   int                 `json:"version"`
+	Retired   []rolloverEntry     `json:"retired"`
+	Staged    []stagedKey         `json:"staged,omitempty"`
+	Revoked   []string            `json:"revoked,omitempty"`
+	RevokedIn map[string][]string `json:"revoked_in,omitempty"`
+}
+
+// rollover keeps retired records next to their successors for a hold
+// period, so resolvers that cached the old RRset accept the new key. The
+// state is kept in a file between runs, shared by every zone, along with the
+// keys staged for the lineages and the revoked keys with the zones they were
+// removed from. A nil rollover retires records at once.
+type rollover struct {
+	file      string
+	zone      string
+	hold      time.Duration
+	now       time.Time
+	entries   map[string]rolloverEntry
+	staged    map[string]stagedKey
+	revoked   revokedKeys
+	revokedIn map[string]map[string]bool
+}
+
+// loadRollover reads the state file, which may not exist yet, for changes
+// to zone. A zero hold keeps records for twice the TTL of their RRset.
+func loadRollover(file, zone string, hold time.Duration, now time.Time) (*rollover, error) {
+	if zone != "" {
+		zone = strings.ToLower(dns.Fqdn(zone))
+	}
+	s := &rollover{
+		file:      file,
+		zone:      zone,
+		hold:      hold,
+		now:       now,
+		entries:   make(map[string]rolloverEntry),
+		staged:    make(map[string]stagedKey),
+		revoked:   make(revokedKeys),
+		revokedIn: make(map[string]map[string]bool),
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f rolloverState
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if f.Version != rolloverVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", file, f.Version)
+	}
+	for _, e := range f.Retired {
+		s.entries[rolloverKey(e.Zone, e.Owner, e.Rdata)] = e
+	}
+	for _, k := range f.Staged {
+		s.staged[stagedID(k.Lineage, k.Key)] = k
+	}
+	for _, h := range f.Revoked {
+		s.revoked[h] = true
+	}
+	for h, zones := range f.RevokedIn {
+		s.revokedIn[h] = make(map[string]bool)
+		for _, z := range zones {
+			s.revokedIn[h][z] = true
+		}
+	}
+
+	return s, nil
+}
+
+// rolloverKey identifies a record of zone in the state.
+func rolloverKey(zone, owner, rd string) string {
+	if r, err := parseRRData(rd); err == nil {
+		rd = r.String()
+	}
+	return zone + " " + strings.ToLower(owner) + " " + rd
+}
+
+// stagedID identifies the key spki staged for lineage in the state.
+func stagedID(lineage string, spki []byte) string {
+	h := sha256.Sum256(spki)
+	return lineage + " " + hex.EncodeToString(h[:])
+}
+
+// Stage keeps the records of the key spki published with those of the
+// lineage, whose certificate has the key current, until certbot renews.
+func (s *rollover) Stage(lineage string, spki, current []byte) {
+	s.staged[stagedID(lineage, spki)] = stagedKey{Lineage: lineage, Key: spki, Current: current}
+}
+
+// AddStaged adds the records of the keys staged for the lineage to t, the
+// records of its certificate. A key is dropped once the certificate has it,
+// or once certbot renewed with another key.
+func (s *rollover) AddStaged(t *tlsa, lineage string) {
+	if s == nil {
+		return
+	}
+
+	ids := make([]string, 0, len(s.staged))
+	for id, k := range s.staged {
+		if k.Lineage == lineage {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		k := s.staged[id]
+		h := sha256.Sum256(k.Key)
+		switch {
+		case bytes.Equal(k.Key, t.Key):
+			log.Printf("the staged key %x is live", h)
+			delete(s.staged, id)
+		case !bytes.Equal(k.Current, t.Key):
+			log.Printf("%s was renewed with another key, retiring the staged key %x", lineage, h)
+			delete(s.staged, id)
+		default:
+			log.Printf("publishing %d TLSA records for the staged key %x", stageKey(t, k.Key), h)
+		}
+	}
+}
+
+// Revoke adds the key with the SPKI SHA-256 digest hash to the deny-list,
+// notes that it was removed from the zone and drops it from the staged keys.
+func (s *rollover) Revoke(hash string) {
+	s.revoked[hash] = true
+	if s.revokedIn[hash] == nil {
+		s.revokedIn[hash] = make(map[string]bool)
+	}
+	s.revokedIn[hash][s.zone] = true
+	for id, k := range s.staged {
+		if s.revoked.Key(k.Key) {
+			delete(s.staged, id)
+		}
+	}
+}
+
+// Hold reports whether the record rd of r, which cdh is about to retire,
+// stays published. The hold period starts the first time it is asked for.
+// Records of revoked keys are never held.
+func (s *rollover) Hold(r *rrset, rd string) bool {
+	if s == nil {
+		return false
+	}
+
+	k := rolloverKey(s.zone, r.Name, rd)
+	if rec, err := parseRRData(rd); err == nil && s.revoked.Record(rec) {
+		delete(s.entries, k)
+		return false
+	}
+	e, ok := s.entries[k]
+	if !ok {
+		hold := s.hold
+		if hold == 0 {
+			hold = 2 * time.Duration(r.TTL) * time.Second
+		}
+		e = rolloverEntry{Zone: s.zone, Owner: r.Name, Rdata: rd, Until: s.now.Add(hold)}
+		s.entries[k] = e
+	}
+	if s.now.Before(e.Until) {
+		return true
+	}
+
+	delete(s.entries, k)
+	return false
+}
+
+// Due reports whether the record rd of owner was retired and its hold
+// period is over.
+func (s *rollover) Due(owner, rd string) bool {
+	e, ok := s.entries[rolloverKey(s.zone, owner, rd)]
+	return ok && !s.now.Before(e.Until)
+}
+
+// Forget drops the records of owner that are published again, or removed,
+// from the state.
+func (s *rollover) Forget(owner string, rrdatas []string) {
+	if s == nil {
+		return
+	}
+	for _, rd := range rrdatas {
+		delete(s.entries, rolloverKey(s.zone, owner, rd))
+	}
+}
+
+// Prune drops the records of the zone whose hold period is over and that
+// are no longer in rR from the state, as nothing is left to remove.
+func (s *rollover) Prune(rR []*rrset) {
+	present := make(map[string]bool)
+	for _, r := range rR {
+		if r.Type != "TLSA" {
+			continue
+		}
+		for _, rd := range r.Rrdatas {
+			present[rolloverKey(s.zone, r.Name, rd)] = true
+		}
+	}
+
+	for k, e := range s.entries {
+		if e.Zone == s.zone && !s.now.Before(e.Until) && !present[k] {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// DueElsewhere returns the sorted zones, other than the one of the run, that
+// have retired records whose hold period is over.
+func (s *rollover) DueElsewhere() []string {
+	due := make(map[string]bool)
+	for _, e := range s.entries {
+		if e.Zone != s.zone && !s.now.Before(e.Until) {
+			due[e.Zone] = true
+		}
+	}
+
+	zones := make([]string, 0, len(due))
+	for z := range due {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// RevokePending returns the sorted zones of the state file that the key with
+// the SPKI SHA-256 digest hash was not removed from: those with retired
+// records or where another key was revoked.
+func (s *rollover) RevokePending(hash string) []string {
+	known := make(map[string]bool)
+	for _, e := range s.entries {
+		known[e.Zone] = true
+	}
+	for _, in := range s.revokedIn {
+		for z := range in {
+			known[z] = true
+		}
+	}
+
+	var zones []string
+	for z := range known {
+		if z != "" && !s.revokedIn[hash][z] {
+			zones = append(zones, z)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// Save writes the state back to its file, if there is one. Entries stay
+// until their record is retired or forgotten, whichever zone or run they
+// belong to.
+func (s *rollover) Save() error {
+	if s == nil {
+		return nil
+	}
+
+	f := rolloverState{Version: rolloverVersion, Retired: []rolloverEntry{}}
+	for _, e := range s.entries {
+		f.Retired = append(f.Retired, e)
+	}
+	sort.Slice(f.Retired, func(i, j int) bool {
+		a, b := f.Retired[i], f.Retired[j]
+		return rolloverKey(a.Zone, a.Owner, a.Rdata) < rolloverKey(b.Zone, b.Owner, b.Rdata)
+	})
+	for _, k := range s.staged {
+		f.Staged = append(f.Staged, k)
+	}
+	sort.Slice(f.Staged, func(i, j int) bool {
+		return stagedID(f.Staged[i].Lineage, f.Staged[i].Key) < stagedID(f.Staged[j].Lineage, f.Staged[j].Key)
+	})
+	for h := range s.revoked {
+		f.Revoked = append(f.Revoked, h)
+	}
+	sort.Strings(f.Revoked)
+	for h, in := range s.revokedIn {
+		if f.RevokedIn == nil {
+			f.RevokedIn = make(map[string][]string)
+		}
+		for z := range in {
+			f.RevokedIn[h] = append(f.RevokedIn[h], z)
+		}
+		sort.Strings(f.RevokedIn[h])
+	}
+
+	data, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if _, err := os.Stat(s.file); errors.Is(err, fs.ErrNotExist) {
+		return os.WriteFile(s.file, data, 0o600)
+	}
+	return writeFileAtomic(s.file, data)
+}
+
+// holdRRData returns rrdatas followed by the records of old that are not
+// among them and are held for a rollover.
+func holdRRData(old *rrset, rrdatas []string, s *rollover) []string {
+	seen := make(map[string]bool)
+	for _, rd := range rrdatas {
+		seen[rolloverKey("", old.Name, rd)] = true
+	}
+	for _, rd := range old.Rrdatas {
+		if k := rolloverKey("", old.Name, rd); !seen[k] && s.Hold(old, rd) {
+			seen[k] = true
+			rrdatas = append(rrdatas, rd)
+		}
+	}
+	return rrdatas
+}
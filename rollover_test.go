@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollover(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rollover.json")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &rrset{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600, Rrdatas: []string{"3 1 1 aaaa"}}
+
+	s, err := loadRollover(f, "example.com", 0, now)
+	assert.NoError(t, err, "Expected missing state file to be accepted")
+	assert.True(t, s.Hold(r, "3 1 1 AAAA"), "Expected record to be held")
+	assert.NoError(t, s.Save(), "Expected no error")
+
+	// One TTL later the record is still held.
+	s, err = loadRollover(f, "example.com", 0, now.Add(time.Hour))
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected record to be held for twice the TTL")
+
+	s, err = loadRollover(f, "example.com", 0, now.Add(2*time.Hour))
+	assert.NoError(t, err, "Expected no error")
+	assert.False(t, s.Hold(r, "3 1 1 aaaa"), "Expected record to be retired after the hold period")
+	assert.NoError(t, s.Save(), "Expected no error")
+
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.JSONEq(t, `{"version": 1, "retired": []}`, string(data), "Expected retired record to be dropped")
+
+	var nilState *rollover
+	assert.False(t, nilState.Hold(r, "3 1 1 aaaa"), "Expected records to be retired without state")
+	assert.NoError(t, nilState.Save(), "Expected nothing to save without state")
+}
+
+func TestRolloverSave(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rollover.json")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &rrset{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600}
+
+	s, err := loadRollover(f, "example.com", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected record to be held")
+	assert.NoError(t, s.Save(), "Expected no error")
+
+	// Runs that do not touch the record keep it after its hold period.
+	for _, z := range []string{"example.com", "example.net"} {
+		s, err = loadRollover(f, z, 0, now.Add(3*time.Hour))
+		assert.NoError(t, err, "Expected no error")
+		assert.NoError(t, s.Save(), "Expected no error")
+	}
+
+	s, err = loadRollover(f, "example.com.", 0, now.Add(3*time.Hour))
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, s.Due(r.Name, "3 1 1 aaaa"), "Expected record to be due")
+
+	s, err = loadRollover(f, "example.net", 0, now.Add(3*time.Hour))
+	assert.NoError(t, err, "Expected no error")
+	assert.False(t, s.Due(r.Name, "3 1 1 aaaa"), "Expected records of other zones to be left alone")
+}
+
+func TestRolloverHold(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := &rrset{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 3600}
+
+	s, err := loadRollover(filepath.Join(t.TempDir(), "rollover.json"), "example.com", 24*time.Hour, now)
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected record to be held")
+	s.now = now.Add(23 * time.Hour)
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected configured hold period")
+
+	// A record that is published again starts over when retired.
+	s.Forget(r.Name, []string{"3 1 1 aaaa"})
+	s.now = now.Add(25 * time.Hour)
+	assert.True(t, s.Hold(r, "3 1 1 aaaa"), "Expected a new hold period")
+}
+
+func TestRolloverVersion(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rollover.json")
+	assert.NoError(t, os.WriteFile(f, []byte(`{"version": 2}`), 0o600), "Expected no error")
+
+	_, err := loadRollover(f, "example.com", 0, time.Now())
+
+	assert.ErrorContains(t, err, "unsupported version 2", "Expected unknown version to be refused")
+}
+
+func TestNewChangeRollover(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := filepath.Join(t.TempDir(), "rollover.json")
+	existing := []*rrset{{
+		Name:    "_443._tcp.example.com.",
+		Type:    "TLSA",
+		TTL:     300,
+		Rrdatas: []string{"3 1 1 aaaa", "2 1 1 cccc"},
+	}}
+	d := testTLSA("bbbb", "cccc", "example.com.")
+
+	s, err := loadRollover(f, "example.com", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	cset, _ := newChange(existing, d, changeOptions{Rollover: s})
+	assert.Equal(t, []string{"3 1 1 bbbb", "2 1 1 cccc", "3 1 1 aaaa"}, cset.Additions[0].Rrdatas, "Expected old key next to the new one")
+	assert.NoError(t, s.Save(), "Expected no error")
+
+	existing[0].Rrdatas = cset.Additions[0].Rrdatas
+	s, err = loadRollover(f, "example.com", 0, now.Add(10*time.Minute))
+	assert.NoError(t, err, "Expected no error")
+	cset, _ = newChange(existing, d, changeOptions{Rollover: s})
+	assert.Equal(t, []string{"3 1 1 bbbb", "2 1 1 cccc"}, cset.Additions[0].Rrdatas, "Expected old key to be retired")
+}
+
+func TestNewChangeRolloverRegistry(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry := `"` + registryEntry{"example.com", "3-1-1:aaaa", now}.String() + `"`
+	existing := []*rrset{
+		{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 aaaa"}},
+		{Name: "_443._tcp.example.com.", Type: "TXT", TTL: 300, Rrdatas: []string{entry}},
+	}
+
+	s, err := loadRollover(filepath.Join(t.TempDir(), "rollover.json"), "example.com", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	cset, _ := newChange(existing, testTLSA("bbbb", "", "example.com."), changeOptions{
+		Registry: true,
+		Lineage:  "example.com",
+		Now:      now,
+		Rollover: s,
+	})
+
+	assert.Equal(t, []string{"3 1 1 bbbb", "3 1 1 aaaa"}, cset.Additions[0].Rrdatas, "Expected old key to be held")
+	assert.Equal(t, []string{
+		`"` + registryEntry{"example.com", "3-1-1:bbbb", now}.String() + `"`,
+		entry,
+	}, cset.Additions[1].Rrdatas, "Expected held key to stay registered")
+}
+
+func TestRolloverStaged(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rollover.json")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	next := []byte("next key")
+	h := sha256.Sum256(next)
+	staged := "3 1 1 " + hex.EncodeToString(h[:])
+
+	s, err := loadRollover(f, "example.com", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	s.Stage("example.com", next, []byte("current key"))
+	assert.NoError(t, s.Save(), "Expected no error")
+
+	s, err = loadRollover(f, "example.net", 0, now)
+	assert.NoError(t, err, "Expected no error")
+	d := testTLSA("aaaa", "cccc", "example.com.")
+	d.Key = []byte("current key")
+	s.AddStaged(d, "example.com")
+	assert.Contains(t, d.MakeRRData(), staged, "Expected staged key to be published in every zone")
+
+	d = testTLSA("bbbb", "cccc", "other.example.com.")
+	s.AddStaged(d, "other")
+	assert.NotContains(t, d.MakeRRData(), staged, "Expected other lineages to be left alone")
+
+	// A renewal with another key passes the staged key over.
+	d = testTLSA("dddd", "cccc", "example.com.")
+	d.Key = []byte("other key")
+	s.AddStaged(d, "example.com")
+	assert.NotContains(t, d.MakeRRData(), staged, "Expected staged key to be retired")
+	assert.Empty(t, s.staged, "Expected staged key to be dropped")
+}
@@ -0,0 +1,301 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// route53Endpoint is the default endpoint of the Route 53 API.
+const route53Endpoint = "https://route53.amazonaws.com"
+
+// route53Namespace is the XML namespace of the Route 53 API.
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+type route53RRset struct {
+	Name            string          `xml:"Name"`
+	Type            string          `xml:"Type"`
+	TTL             int64           `xml:"TTL,omitempty"`
+	ResourceRecords []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Change struct {
+	Action            string       `xml:"Action"`
+	ResourceRecordSet route53RRset `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53ChangeInfo struct {
+	ID     string `xml:"ChangeInfo>Id"`
+	Status string `xml:"ChangeInfo>Status"`
+}
+
+type route53ListResponse struct {
+	RRsets               []route53RRset `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated          bool           `xml:"IsTruncated"`
+	NextRecordName       string         `xml:"NextRecordName"`
+	NextRecordType       string         `xml:"NextRecordType"`
+	NextRecordIdentifier string         `xml:"NextRecordIdentifier"`
+}
+
+type route53HostedZones struct {
+	HostedZones []struct {
+		ID   string `xml:"Id"`
+		Name string `xml:"Name"`
+	} `xml:"HostedZones>HostedZone"`
+}
+
+type route53Error struct {
+	Code     string   `xml:"Error>Code"`
+	Message  string   `xml:"Error>Message"`
+	Messages []string `xml:"Messages>Message"`
+}
+
+// route53Provider manages TLSA records in an AWS Route 53 hosted zone.
+type route53Provider struct {
+	endpoint string
+	creds    *awsCredentials
+	client   *http.Client
+	zoneID   string
+	interval time.Duration
+}
+
+// newRoute53Provider creates a Route 53 provider. The key file is an AWS
+// shared credentials file; without it the standard environment variables
+// are used. The hosted zone is looked up by the name of the zone.
+func newRoute53Provider(ctx context.Context, cfg providerConfig) (provider, error) {
+	creds, err := readAWSCredentials(cfg.KeyFile, cfg.Options["profile"])
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := cfg.Options["endpoint"]
+	if endpoint == "" {
+		endpoint = route53Endpoint
+	}
+
+	p := &route53Provider{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		client:   http.DefaultClient,
+		zoneID:   cfg.Options["zone-id"],
+		interval: 5 * time.Second,
+	}
+
+	if p.zoneID == "" {
+		if p.zoneID, err = p.findZone(ctx, dns.Fqdn(cfg.Zone)); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// do sends a signed request to the Route 53 API. The request body and the
+// response are encoded as XML.
+func (p *route53Provider) do(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := xml.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(append([]byte(xml.Header), data...))
+	}
+
+	u := p.endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	if err := signV4(req, p.creds, "us-east-1", "route53", time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var e route53Error
+		if xml.Unmarshal(data, &e) == nil {
+			if e.Code != "" {
+				return fmt.Errorf("route53: %s %s: %s: %s", method, path, e.Code, e.Message)
+			}
+			if len(e.Messages) > 0 {
+				return fmt.Errorf("route53: %s %s: %s", method, path, strings.Join(e.Messages, "; "))
+			}
+		}
+		return fmt.Errorf("route53: %s %s: %s", method, path, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// findZone returns the ID of the hosted zone named zone.
+func (p *route53Provider) findZone(ctx context.Context, zone string) (string, error) {
+	var resp route53HostedZones
+	err := p.do(ctx, http.MethodGet, "/2013-04-01/hostedzonesbyname", url.Values{
+		"dnsname":  {zone},
+		"maxitems": {"1"},
+	}, nil, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	for _, z := range resp.HostedZones {
+		if strings.EqualFold(dns.Fqdn(z.Name), zone) {
+			return strings.TrimPrefix(z.ID, "/hostedzone/"), nil
+		}
+	}
+
+	return "", fmt.Errorf("route53: no hosted zone named %s", zone)
+}
+
+// List returns the TLSA and TXT resource record sets in the hosted zone,
+// following the pagination of ListResourceRecordSets.
+func (p *route53Provider) List(ctx context.Context) ([]*rrset, error) {
+	var rr []*rrset
+	query := url.Values{}
+
+	for {
+		var resp route53ListResponse
+		if err := p.do(ctx, http.MethodGet, "/2013-04-01/hostedzone/"+p.zoneID+"/rrset", query, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, r := range resp.RRsets {
+			if !managedType(r.Type) {
+				continue
+			}
+			s := &rrset{Name: r.Name, Type: r.Type, TTL: r.TTL}
+			for _, v := range r.ResourceRecords {
+				s.Rrdatas = append(s.Rrdatas, v.Value)
+			}
+			rr = append(rr, s)
+		}
+
+		if !resp.IsTruncated {
+			return rr, nil
+		}
+		query = url.Values{
+			"name": {resp.NextRecordName},
+			"type": {resp.NextRecordType},
+		}
+		if resp.NextRecordIdentifier != "" {
+			query.Set("identifier", resp.NextRecordIdentifier)
+		}
+	}
+}
+
+// toRoute53 converts an rrset to a Route 53 change.
+func toRoute53(action string, r *rrset) route53Change {
+	c := route53Change{
+		Action: action,
+		ResourceRecordSet: route53RRset{
+			Name: r.Name,
+			Type: r.Type,
+			TTL:  r.TTL,
+		},
+	}
+	for _, d := range r.Rrdatas {
+		c.ResourceRecordSet.ResourceRecords = append(c.ResourceRecordSet.ResourceRecords, route53Record{Value: d})
+	}
+	return c
+}
+
+// Apply submits the changeset as one change batch. RRsets that are both
+// deleted and added are replaced with UPSERT, the others are deleted or
+// upserted on their own. It returns the ID of the change.
+func (p *route53Provider) Apply(ctx context.Context, c *changeset) (string, error) {
+	added := make(map[string]bool)
+	for _, r := range c.Additions {
+		added[rrsetKey(r.Name, r.Type)] = true
+	}
+
+	req := route53ChangeRequest{Xmlns: route53Namespace}
+	for _, r := range c.Deletions {
+		if !added[rrsetKey(r.Name, r.Type)] {
+			req.Changes = append(req.Changes, toRoute53("DELETE", r))
+		}
+	}
+	for _, r := range c.Additions {
+		req.Changes = append(req.Changes, toRoute53("UPSERT", r))
+	}
+
+	var resp route53ChangeInfo
+	if err := p.do(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+p.zoneID+"/rrset", nil, req, &resp); err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(resp.ID, "/change/"), nil
+}
+
+// Wait polls the change until Route 53 reports it as INSYNC.
+func (p *route53Provider) Wait(ctx context.Context, id string) error {
+	for {
+		var resp route53ChangeInfo
+		if err := p.do(ctx, http.MethodGet, "/2013-04-01/change/"+id, nil, nil, &resp); err != nil {
+			return err
+		}
+		if resp.Status == "INSYNC" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.interval):
+		}
+	}
+}
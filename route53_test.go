@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRoute53(t *testing.T, h http.Handler) *route53Provider {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t,
+			strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/"),
+			"Expected signed request",
+		)
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/route53/aws4_request", "Expected Route 53 scope")
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	p, err := newRoute53Provider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		Options: options{"endpoint": srv.URL},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	return p.(*route53Provider)
+}
+
+func route53ZoneHandler(mux *http.ServeMux) {
+	mux.HandleFunc("GET /2013-04-01/hostedzonesbyname", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<ListHostedZonesByNameResponse><HostedZones>
+<HostedZone><Id>/hostedzone/Z123</Id><Name>%s</Name></HostedZone>
+</HostedZones></ListHostedZonesByNameResponse>`, r.URL.Query().Get("dnsname"))
+	})
+}
+
+func TestRoute53FindZone(t *testing.T) {
+	mux := http.NewServeMux()
+	route53ZoneHandler(mux)
+
+	p := newTestRoute53(t, mux)
+
+	assert.Equal(t, "Z123", p.zoneID, "Expected hosted zone ID")
+}
+
+func TestRoute53FindZoneMissing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /2013-04-01/hostedzonesbyname", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<ListHostedZonesByNameResponse><HostedZones>
+<HostedZone><Id>/hostedzone/Z999</Id><Name>other.com.</Name></HostedZone>
+</HostedZones></ListHostedZonesByNameResponse>`)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	_, err := newRoute53Provider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		Options: options{"endpoint": srv.URL},
+	})
+
+	assert.ErrorContains(t, err, "no hosted zone named example.com.", "Expected missing zone to be refused")
+}
+
+func TestRoute53List(t *testing.T) {
+	mux := http.NewServeMux()
+	route53ZoneHandler(mux)
+	mux.HandleFunc("GET /2013-04-01/hostedzone/Z123/rrset", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") == "" {
+			fmt.Fprint(w, `<ListResourceRecordSetsResponse><ResourceRecordSets>
+<ResourceRecordSet><Name>example.com.</Name><Type>A</Type><TTL>300</TTL>
+<ResourceRecords><ResourceRecord><Value>192.0.2.1</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+<ResourceRecordSet><Name>_443._tcp.example.com.</Name><Type>TLSA</Type><TTL>300</TTL>
+<ResourceRecords><ResourceRecord><Value>3 1 1 abcdef</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+</ResourceRecordSets><IsTruncated>true</IsTruncated>
+<NextRecordName>_443._tcp.www.example.com.</NextRecordName><NextRecordType>TLSA</NextRecordType>
+</ListResourceRecordSetsResponse>`)
+			return
+		}
+
+		assert.Equal(t, "_443._tcp.www.example.com.", r.URL.Query().Get("name"), "Expected next name")
+		assert.Equal(t, "TLSA", r.URL.Query().Get("type"), "Expected next type")
+		fmt.Fprint(w, `<ListResourceRecordSetsResponse><ResourceRecordSets>
+<ResourceRecordSet><Name>_443._tcp.www.example.com.</Name><Type>TLSA</Type><TTL>300</TTL>
+<ResourceRecords><ResourceRecord><Value>3 1 1 abcdef</Value></ResourceRecord>
+<ResourceRecord><Value>2 1 1 123456</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>
+</ResourceRecordSets><IsTruncated>false</IsTruncated></ListResourceRecordSetsResponse>`)
+	})
+
+	p := newTestRoute53(t, mux)
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef"},
+		},
+		{
+			Name:    "_443._tcp.www.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef", "2 1 1 123456"},
+		},
+	}, rr, "Expected TLSA RRsets from both pages")
+}
+
+func TestRoute53ApplyWait(t *testing.T) {
+	var got route53ChangeRequest
+
+	mux := http.NewServeMux()
+	route53ZoneHandler(mux)
+	mux.HandleFunc("POST /2013-04-01/hostedzone/Z123/rrset", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, xml.NewDecoder(r.Body).Decode(&got), "Expected no error")
+		fmt.Fprint(w, `<ChangeResourceRecordSetsResponse><ChangeInfo>
+<Id>/change/C42</Id><Status>PENDING</Status>
+</ChangeInfo></ChangeResourceRecordSetsResponse>`)
+	})
+	polls := 0
+	mux.HandleFunc("GET /2013-04-01/change/C42", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		status := "PENDING"
+		if polls > 1 {
+			status = "INSYNC"
+		}
+		fmt.Fprintf(w, `<GetChangeResponse><ChangeInfo><Id>/change/C42</Id><Status>%s</Status></ChangeInfo></GetChangeResponse>`, status)
+	})
+
+	p := newTestRoute53(t, mux)
+	p.interval = 0
+
+	id, err := p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 0000"}},
+			{Name: "_443._tcp.old.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 0000"}},
+		},
+		Additions: []*rrset{
+			{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 abcdef"}},
+		},
+	})
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "C42", id, "Expected change ID")
+
+	assert.Equal(t, []route53Change{
+		{
+			Action: "DELETE",
+			ResourceRecordSet: route53RRset{
+				Name:            "_443._tcp.old.example.com.",
+				Type:            "TLSA",
+				TTL:             300,
+				ResourceRecords: []route53Record{{Value: "3 1 1 0000"}},
+			},
+		},
+		{
+			Action: "UPSERT",
+			ResourceRecordSet: route53RRset{
+				Name:            "_443._tcp.example.com.",
+				Type:            "TLSA",
+				TTL:             300,
+				ResourceRecords: []route53Record{{Value: "3 1 1 abcdef"}},
+			},
+		},
+	}, got.Changes, "Expected replaced RRset to be upserted")
+
+	assert.NoError(t, p.Wait(context.Background(), id), "Expected no error")
+	assert.Equal(t, 2, polls, "Expected polling until INSYNC")
+}
+
+func TestRoute53Error(t *testing.T) {
+	mux := http.NewServeMux()
+	route53ZoneHandler(mux)
+	mux.HandleFunc("POST /2013-04-01/hostedzone/Z123/rrset", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidChangeBatch</Code><Message>bad rdata</Message></Error></ErrorResponse>`)
+	})
+
+	p := newTestRoute53(t, mux)
+	_, err := p.Apply(context.Background(), &changeset{
+		Additions: []*rrset{{Name: "_443._tcp.example.com.", Type: "TLSA", TTL: 300, Rrdatas: []string{"3 1 1 zz"}}},
+	})
+
+	assert.ErrorContains(t, err, "InvalidChangeBatch: bad rdata", "Expected API error")
+}
@@ -0,0 +1,161 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// service is a port and transport protocol a TLSA record is published for.
+type service struct {
+	Port  uint16
+	Proto string
+}
+
+// String returns the service in port/proto form, such as "443/tcp".
+func (s service) String() string {
+	return fmt.Sprintf("%d/%s", s.Port, s.Proto)
+}
+
+// Owner returns the TLSA owner name of the service at host.
+func (s service) Owner(host string) string {
+	return fmt.Sprintf("_%d._%s.%s", s.Port, s.Proto, dns.Fqdn(host))
+}
+
+// parseService parses a service such as "25/tcp" or "443/udp".
+func parseService(s string) (service, error) {
+	port, proto, ok := strings.Cut(s, "/")
+	if !ok {
+		proto = "tcp"
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return service{}, fmt.Errorf("invalid port in service %q", s)
+	}
+	switch proto = strings.ToLower(proto); proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return service{}, fmt.Errorf("unsupported protocol in service %q", s)
+	}
+	return service{Port: uint16(n), Proto: proto}, nil
+}
+
+// parseOwner splits a TLSA owner name such as "_25._tcp.mail.example.com."
+// into its service and host.
+func parseOwner(name string) (service, string, error) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return service{}, "", fmt.Errorf("%s is not a _port._proto owner name", name)
+	}
+	svc, err := parseService(labels[0][1:] + "/" + labels[1][1:])
+	if err != nil {
+		return service{}, "", fmt.Errorf("%s: %w", name, err)
+	}
+	return svc, dns.Fqdn(strings.Join(labels[2:], ".")), nil
+}
+
+// containsService reports whether services holds s.
+func containsService(services []service, s service) bool {
+	for _, o := range services {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultServices are used for names no rule matches.
+var defaultServices = []service{{443, "tcp"}}
+
+// serviceRule maps the host names matching Pattern to their services.
+// A pattern is an exact name, a suffix starting with a dot, or a glob.
+type serviceRule struct {
+	Pattern  string
+	Services []service
+}
+
+// Match reports whether host matches the pattern of the rule.
+func (r serviceRule) Match(host string) bool {
+	host = strings.ToLower(dns.Fqdn(host))
+	pattern := strings.ToLower(dns.Fqdn(r.Pattern))
+
+	switch {
+	case strings.ContainsAny(pattern, "*?["):
+		ok, _ := path.Match(pattern, host)
+		return ok
+	case strings.HasPrefix(pattern, "."):
+		return strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+// serviceMap is an ordered list of rules given as repeated -s flags. The
+// first matching rule wins.
+type serviceMap []serviceRule
+
+// String returns the rules separated by spaces.
+func (m *serviceMap) String() string {
+	s := make([]string, 0, len(*m))
+	for _, r := range *m {
+		svcs := make([]string, 0, len(r.Services))
+		for _, v := range r.Services {
+			svcs = append(svcs, v.String())
+		}
+		s = append(s, r.Pattern+"="+strings.Join(svcs, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses a rule such as "mail.example.com=25/tcp,465/tcp" and appends
+// it to the map.
+func (m *serviceMap) Set(v string) error {
+	pattern, list, ok := strings.Cut(v, "=")
+	if !ok || pattern == "" || list == "" {
+		return fmt.Errorf("service rule %q is not in pattern=port/proto,... form", v)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	r := serviceRule{Pattern: pattern}
+	for _, s := range strings.Split(list, ",") {
+		svc, err := parseService(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		r.Services = append(r.Services, svc)
+	}
+
+	*m = append(*m, r)
+	return nil
+}
+
+// Lookup returns the services of host.
+func (m serviceMap) Lookup(host string) []service {
+	for _, r := range m {
+		if r.Match(host) {
+			return r.Services
+		}
+	}
+	return defaultServices
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseService(t *testing.T) {
+	for s, want := range map[string]service{
+		"25/tcp":  {25, "tcp"},
+		"443/UDP": {443, "udp"},
+		"993":     {993, "tcp"},
+	} {
+		svc, err := parseService(s)
+		assert.NoError(t, err, "Expected no error")
+		assert.Equal(t, want, svc, "Expected %q to parse", s)
+	}
+
+	for _, s := range []string{"", "0/tcp", "70000/tcp", "x/tcp", "25/icmp"} {
+		_, err := parseService(s)
+		assert.Error(t, err, "Expected %q to be refused", s)
+	}
+
+	assert.Equal(t, "_443._udp.example.com.", service{443, "udp"}.Owner("example.com"), "Expected owner name")
+}
+
+func TestParseOwner(t *testing.T) {
+	svc, host, err := parseOwner("_25._TCP.mail.example.com.")
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, service{25, "tcp"}, svc, "Expected service")
+	assert.Equal(t, "mail.example.com.", host, "Expected host")
+
+	for _, name := range []string{".", "com.", "_443._tcp.", "www.example.com.", "_443.www.example.com.", "_x._tcp.example.com.", "_443._icmp.example.com."} {
+		_, _, err := parseOwner(name)
+		assert.Error(t, err, "Expected %q to be refused", name)
+	}
+}
+
+func TestServiceRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"mail.example.com", "mail.example.com.", true},
+		{"mail.example.com", "MAIL.example.com.", true},
+		{"mail.example.com", "smtp.mail.example.com.", false},
+		{".example.com", "mail.example.com.", true},
+		{".example.com", "a.b.example.com.", true},
+		{".example.com", "example.com.", false},
+		{"mx?.example.com", "mx1.example.com.", true},
+		{"mx?.example.com", "mx10.example.com.", false},
+		{"*.example.com.", "www.example.com.", true},
+		{"*.example.com.", "example.com.", false},
+	}
+
+	for _, tt := range tests {
+		r := serviceRule{Pattern: tt.pattern}
+		assert.Equal(t, tt.match, r.Match(tt.host), "Expected %s against %s", tt.host, tt.pattern)
+	}
+}
+
+func TestServiceMap(t *testing.T) {
+	var m serviceMap
+	assert.NoError(t, m.Set("mail.example.com=25/tcp,465/tcp"), "Expected no error")
+	assert.NoError(t, m.Set(".example.com=993/tcp"), "Expected no error")
+	assert.Equal(t, "mail.example.com=25/tcp,465/tcp .example.com=993/tcp", m.String(), "Expected rules to be printed")
+
+	assert.Equal(t, []service{{25, "tcp"}, {465, "tcp"}}, m.Lookup("mail.example.com."), "Expected first match to win")
+	assert.Equal(t, []service{{993, "tcp"}}, m.Lookup("imap.example.com."), "Expected suffix match")
+	assert.Equal(t, defaultServices, m.Lookup("example.org."), "Expected default services")
+
+	for _, v := range []string{"mail.example.com", "=25/tcp", "a=", "[=25/tcp", "a=25/foo"} {
+		assert.Error(t, m.Set(v), "Expected %q to be refused", v)
+	}
+}
@@ -0,0 +1,132 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sig0Key is a SIG(0) key pair read from BIND K*.key and K*.private files.
+type sig0Key struct {
+	Key    *dns.KEY
+	Signer crypto.Signer
+}
+
+// readSIG0Key reads the private key file f and the public KEY record stored
+// next to it with the .key extension.
+func readSIG0Key(f string) (*sig0Key, error) {
+	rr, signer, err := readKeyPair(f)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.KEY)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a KEY record", f)
+	}
+
+	return &sig0Key{Key: key, Signer: signer}, nil
+}
+
+// Sign appends a SIG(0) record to the message and returns the wire format.
+func (k *sig0Key) Sign(m *dns.Msg) ([]byte, error) {
+	now := time.Now().Unix()
+
+	sig := &dns.SIG{
+		RRSIG: dns.RRSIG{
+			Algorithm:  k.Key.Algorithm,
+			KeyTag:     k.Key.KeyTag(),
+			SignerName: k.Key.Hdr.Name,
+			Inception:  uint32(now - 300),
+			Expiration: uint32(now + 300),
+		},
+	}
+
+	return sig.Sign(k.Signer, m)
+}
+
+// keyBits holds the key sizes used by keygen for each algorithm.
+var keyBits = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.RSASHA512:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+	dns.ED25519:         256,
+}
+
+// keygen generates a SIG(0) key pair for name, writes it in BIND format and
+// prints the KEY record to publish in the zone.
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := fs.String("a", "ECDSAP256SHA256", "DNSSEC algorithm of the key")
+	dir := fs.String("d", ".", "directory to write the key files to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cdh keygen [-a algorithm] [-d dir] name")
+	}
+
+	a, ok := dns.StringToAlgorithm[strings.ToUpper(*alg)]
+	if !ok {
+		return fmt.Errorf("unknown algorithm %s", *alg)
+	}
+	bits, ok := keyBits[a]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %s", *alg)
+	}
+
+	key := &dns.KEY{
+		DNSKEY: dns.DNSKEY{
+			Hdr: dns.RR_Header{
+				Name:   dns.Fqdn(fs.Arg(0)),
+				Rrtype: dns.TypeKEY,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Flags:     512, // host key
+			Protocol:  3,
+			Algorithm: a,
+		},
+	}
+	priv, err := key.Generate(bits)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(
+		*dir,
+		fmt.Sprintf("K%s+%03d+%05d", key.Hdr.Name, key.Algorithm, key.KeyTag()),
+	)
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		return err
+	}
+
+	fmt.Println(key.String())
+
+	return nil
+}
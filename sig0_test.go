@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeygen(t *testing.T) {
+	dir := t.TempDir()
+
+	err := keygen([]string{"-d", dir, "cdh.example.com"})
+	assert.NoError(t, err, "Expected no error")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "Kcdh.example.com.+013+*.private"))
+	assert.Len(t, files, 1, "Expected one private key file")
+
+	k, err := readSIG0Key(files[0])
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "cdh.example.com.", k.Key.Hdr.Name, "Expected key name to match")
+	assert.NotNil(t, k.Signer, "Expected a signer")
+}
+
+func TestReadSIG0KeyMissingPublic(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "Kmissing.+013+00001.private")
+	assert.NoError(t, os.WriteFile(f, []byte(""), 0o600), "Expected no error")
+
+	_, err := readSIG0Key(f)
+
+	assert.Error(t, err, "Expected missing public key to fail")
+}
+
+func TestRFC2136SIG0(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, keygen([]string{"-d", dir, "cdh.example.com"}), "Expected no error")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.private"))
+	k, err := readSIG0Key(files[0])
+	assert.NoError(t, err, "Expected no error")
+
+	s := newTestPrimary(t)
+	s.sig0 = k.Key
+
+	p, err := newRFC2136Provider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		KeyFile: files[0],
+		Options: options{"server": s.addr},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("abcdef123456", "123456abcdef", "example.com.")
+	cset, _ := newChange(rr, d, changeOptions{})
+	_, err = p.Apply(context.Background(), cset)
+
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err = p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 abcdef123456", "2 1 1 123456abcdef"},
+		},
+	}, rr, "Expected TLSA RRset to be replaced")
+}
+
+func TestRFC2136SIG0Rejected(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, keygen([]string{"-d", dir, "cdh.example.com"}), "Expected no error")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.private"))
+
+	other := t.TempDir()
+	assert.NoError(t, keygen([]string{"-d", other, "other.example.com"}), "Expected no error")
+	others, _ := filepath.Glob(filepath.Join(other, "*.private"))
+	k, _ := readSIG0Key(others[0])
+
+	s := newTestPrimary(t)
+	s.sig0 = k.Key
+
+	p, err := newRFC2136Provider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		KeyFile: files[0],
+		Options: options{"server": s.addr},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	_, err = p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{{Name: "_443._tcp.example.com.", Type: "TLSA"}},
+	})
+
+	assert.ErrorContains(t, err, "NOTAUTH", "Expected update to be refused")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAWSCredentials = `[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+# deploy profile
+[deploy]
+aws_access_key_id=AKIDDEPLOY
+aws_secret_access_key=deploy-secret
+aws_session_token=deploy-token
+`
+
+func TestReadAWSCredentials(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "credentials")
+	assert.NoError(t, os.WriteFile(f, []byte(testAWSCredentials), 0o600), "Expected no error")
+	t.Setenv("AWS_PROFILE", "")
+
+	c, err := readAWSCredentials(f, "")
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &awsCredentials{AccessKeyID: "AKIDDEFAULT", SecretAccessKey: "default-secret"}, c, "Expected default profile")
+
+	c, err = readAWSCredentials(f, "deploy")
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &awsCredentials{
+		AccessKeyID:     "AKIDDEPLOY",
+		SecretAccessKey: "deploy-secret",
+		SessionToken:    "deploy-token",
+	}, c, "Expected deploy profile")
+
+	_, err = readAWSCredentials(f, "missing")
+	assert.ErrorContains(t, err, "no credentials for profile missing", "Expected missing profile to be refused")
+}
+
+func TestReadAWSCredentialsEnv(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	c, err := readAWSCredentials("", "")
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, &awsCredentials{AccessKeyID: "AKIDENV", SecretAccessKey: "env-secret"}, c, "Expected credentials from the environment")
+}
+
+func TestSignV4(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation.
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	assert.NoError(t, err, "Expected no error")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	c := &awsCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	assert.NoError(t, signV4(req, c, "us-east-1", "iam", now), "Expected no error")
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"), "Expected date header")
+	assert.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+			"SignedHeaders=content-type;host;x-amz-date, "+
+			"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"),
+		"Expected signature to match",
+	)
+}
+
+func TestAWSEscape(t *testing.T) {
+	assert.Equal(t, "a%20b%2Fc~", awsEscape("a b/c~", false), "Expected slash to be escaped")
+	assert.Equal(t, "/a%2Bb/c", awsEscape("/a+b/c", true), "Expected slash to be kept")
+}
@@ -0,0 +1,243 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sethvargo/go-envconfig"
+)
+
+// generateKey creates a private key of the given type, "ecdsa" for P-256 or
+// "rsa" for RSA 2048.
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("unknown key type %s", keyType)
+}
+
+// parseKey parses a PEM encoded private key or certificate signing request.
+// The key is nil for a request.
+func parseKey(data []byte) ([]byte, crypto.Signer, error) {
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, nil, errors.New("no PEM data")
+	}
+
+	var key any
+	var err error
+	switch b.Type {
+	case "CERTIFICATE REQUEST":
+		csr, err := x509.ParseCertificateRequest(b.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, nil, err
+		}
+		return csr.RawSubjectPublicKeyInfo, nil, nil
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(b.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+	default:
+		return nil, nil, fmt.Errorf("unsupported PEM type %s", b.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported key %T", key)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return spki, signer, nil
+}
+
+// readNextKey returns the public key in f, a private key or certificate
+// signing request. If f does not exist, a new private key of keyType is
+// written to it.
+func readNextKey(f, keyType string) ([]byte, crypto.Signer, error) {
+	data, err := os.ReadFile(f)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := generateKey(keyType)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(f, data, 0o600); err != nil {
+			return nil, nil, err
+		}
+		log.Printf("generated the next key in %s", f)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	spki, key, err := parseKey(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", f, err)
+	}
+	return spki, key, nil
+}
+
+// writeCSR writes a certificate signing request for names signed by key.
+func writeCSR(f string, key crypto.Signer, names []string) error {
+	var dnsNames []string
+	for _, n := range names {
+		dnsNames = append(dnsNames, strings.TrimSuffix(n, "."))
+	}
+	if len(dnsNames) == 0 {
+		return errors.New("no names to request")
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: dnsNames[0]},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0o644)
+}
+
+// stageKey adds a record for the public key spki to t for every end entity
+// record that matches the public key, and returns how many it added.
+// Records that match the whole certificate cannot be derived before it is
+// issued.
+func stageKey(t *tlsa, spki []byte) int {
+	n := 0
+	for _, r := range t.Records {
+		if !r.EndEntity() {
+			continue
+		}
+		if r.Selector != 1 {
+			log.Printf("cannot stage TLSA records %s before the certificate is issued, skipping", r.tlsaParams)
+			continue
+		}
+
+		var data string
+		switch r.MatchingType {
+		case 0:
+			data = hex.EncodeToString(spki)
+		case 1:
+			h := sha256.Sum256(spki)
+			data = hex.EncodeToString(h[:])
+		case 2:
+			h := sha512.Sum512(spki)
+			data = hex.EncodeToString(h[:])
+		}
+
+		dup := false
+		for _, o := range t.Records {
+			dup = dup || (o.tlsaParams == r.tlsaParams && o.Data == data)
+		}
+		if !dup {
+			t.Records = append(t.Records, tlsaRecord{r.tlsaParams, data})
+			n++
+		}
+	}
+	return n
+}
+
+// stage pre-publishes the TLSA records of the next key of the lineage next
+// to those of the current certificate, so they are live before certbot
+// renews with that key. The key is kept in the state file, so later updates
+// publish it as well.
+func stage(args []string) error {
+	fs := flag.NewFlagSet("stage", flag.ExitOnError)
+	registerFlags(fs)
+	keyType := fs.String("g", "ecdsa", "type of a generated key: ecdsa or rsa")
+	csrFile := fs.String("c", "", "path to write a certificate signing request for the names of the lineage to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: cdh stage [flags] [-g type] [-c csr] key")
+	}
+
+	if rolloverFile == "" {
+		return errors.New("stage needs the rollover state file given with -f to keep the next key published")
+	}
+
+	ctx := context.Background()
+
+	cfg := config{}
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		return err
+	}
+
+	if err := loadState(); err != nil {
+		return err
+	}
+
+	t, err := readCert(cfg.Cert, certOpts)
+	if err != nil {
+		return err
+	}
+
+	spki, key, err := readNextKey(fs.Arg(0), *keyType)
+	if err != nil {
+		return err
+	}
+	if certOpts.Revoked.Key(spki) {
+		return fmt.Errorf("%s: the key is revoked", fs.Arg(0))
+	}
+	if *csrFile != "" {
+		if key == nil {
+			return errors.New("a certificate signing request needs the private key")
+		}
+		if err := writeCSR(*csrFile, key, t.DNSNames); err != nil {
+			return err
+		}
+	}
+
+	changeOpts.Rollover.Stage(filepath.Base(cfg.Cert), spki, t.Key)
+	return update(ctx, cfg.Cert, t)
+}
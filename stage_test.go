@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadNextKey(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "next.key")
+
+	spki, key, err := readNextKey(f, "ecdsa")
+	assert.NoError(t, err, "Expected no error")
+	assert.IsType(t, &ecdsa.PrivateKey{}, key, "Expected ECDSA key")
+
+	info, err := os.Stat(f)
+	assert.NoError(t, err, "Expected key to be written")
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "Expected private key permissions")
+
+	again, _, err := readNextKey(f, "rsa")
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, spki, again, "Expected existing key to be reused")
+
+	_, _, err = readNextKey(filepath.Join(t.TempDir(), "next.key"), "dsa")
+	assert.ErrorContains(t, err, "unknown key type dsa", "Expected unknown type to be refused")
+}
+
+func TestParseKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err, "Expected no error")
+	want, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err, "Expected no error")
+
+	spki, key, err := parseKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, want, spki, "Expected public key of the RSA key")
+	assert.NotNil(t, key, "Expected private key")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "Expected no error")
+	csr := filepath.Join(t.TempDir(), "next.csr")
+	assert.NoError(t, writeCSR(csr, ecKey, []string{"example.com.", "www.example.com."}), "Expected no error")
+
+	data, err := os.ReadFile(csr)
+	assert.NoError(t, err, "Expected no error")
+	spki, key, err = parseKey(data)
+	assert.NoError(t, err, "Expected no error")
+	want, _ = x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.Equal(t, want, spki, "Expected public key of the request")
+	assert.Nil(t, key, "Expected no private key from a request")
+
+	b, _ := pem.Decode(data)
+	req, err := x509.ParseCertificateRequest(b.Bytes)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []string{"example.com", "www.example.com"}, req.DNSNames, "Expected names of the lineage")
+
+	_, _, err = parseKey([]byte("not PEM"))
+	assert.Error(t, err, "Expected garbage to be refused")
+}
+
+func TestStageKey(t *testing.T) {
+	spki := []byte("next key")
+	h := sha256.Sum256(spki)
+	d := NewTLSA(tlsaParams{3, 1, 1}, tlsaParams{3, 0, 1}, tlsaParams{2, 1, 1})
+	d.Records[0].Data, d.Records[1].Data, d.Records[2].Data = "aaaa", "bbbb", "cccc"
+
+	assert.Equal(t, 1, stageKey(d, spki), "Expected one staged record")
+	assert.Equal(t, []string{"3 1 1 aaaa", "3 0 1 bbbb", "2 1 1 cccc", "3 1 1 " + hex.EncodeToString(h[:])}, d.MakeRRData(), "Expected next key to be published")
+
+	assert.Equal(t, 0, stageKey(d, spki), "Expected staged key not to be added twice")
+}
+
+func TestStage(t *testing.T) {
+	c := newTestChain(t)
+	lineage := writeFullchain(t, c.Leaf.Cert, c.Inter.Cert)
+	t.Setenv("RENEWED_LINEAGE", lineage)
+	t.Setenv("RENEWED_DOMAINS", "example.com")
+	zone := writeTestZone(t)
+	dir := t.TempDir()
+	key := filepath.Join(dir, "next.key")
+	state := filepath.Join(dir, "rollover.json")
+	t.Cleanup(func() {
+		providerOpts = options{}
+		rolloverFile = ""
+		changeOpts = changeOptions{}
+	})
+
+	args := []string{"-p", "zonefile", "-z", "example.com.", "-o", "file=" + zone, "-c", key + ".csr", key}
+	assert.ErrorContains(t, stage(args), "-f", "Expected the state file to be required")
+
+	err := stage(append([]string{"-f", state}, args...))
+	assert.NoError(t, err, "Expected no error")
+
+	spki, next, err := readNextKey(key, "ecdsa")
+	assert.NoError(t, err, "Expected no error")
+	h := sha256.Sum256(spki)
+
+	data, err := os.ReadFile(zone)
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, strings.Contains(string(data), spkiHash(c.Leaf.Cert)), "Expected current key to stay published")
+	assert.True(t, strings.Contains(string(data), hex.EncodeToString(h[:])), "Expected next key to be published")
+
+	_, err = os.Stat(key + ".csr")
+	assert.NoError(t, err, "Expected request to be written")
+
+	// A periodic update of the lineage keeps the next key.
+	assert.NoError(t, loadState(), "Expected no error")
+	d, err := readCert(lineage, certOpts)
+	assert.NoError(t, err, "Expected no error")
+	assert.NoError(t, update(context.Background(), lineage, d), "Expected no error")
+
+	data, err = os.ReadFile(zone)
+	assert.NoError(t, err, "Expected no error")
+	assert.True(t, strings.Contains(string(data), hex.EncodeToString(h[:])), "Expected next key to stay published")
+
+	// Once certbot renews with the next key, it is no longer staged.
+	renewed := newTestCert(t, "example.com", false, c.Inter, next.(*ecdsa.PrivateKey))
+	assert.NoError(t, os.WriteFile(filepath.Join(lineage, "fullchain.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: renewed.Cert.Raw}), 0o644), "Expected no error")
+	assert.NoError(t, loadState(), "Expected no error")
+	d, err = readCert(lineage, certOptions{Params: tlsaParamsList{{3, 1, 1}}})
+	assert.NoError(t, err, "Expected no error")
+	assert.NoError(t, update(context.Background(), lineage, d), "Expected no error")
+
+	data, err = os.ReadFile(state)
+	assert.NoError(t, err, "Expected no error")
+	assert.NotContains(t, string(data), "staged", "Expected live key to be dropped from the state")
+}
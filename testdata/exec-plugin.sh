@@ -0,0 +1,45 @@
+#!/bin/sh
+# Reference plugin for the cdh exec provider.
+#
+# It keeps the zone in the directory given by the "state" option: list
+# prints rrsets.json, apply appends the changeset to changes.log and returns
+# its line number as the change ID, and wait checks that the ID exists. A
+# real plugin would call the API of its DNS system instead.
+
+read -r request
+
+field() {
+	printf '%s\n' "$request" | sed -n "s/.*\"$1\":\"\([^\"]*\)\".*/\1/p"
+}
+
+fail() {
+	printf '{"version":1,"error":"%s"}\n' "$1"
+	exit 0
+}
+
+case "$request" in
+'{"version":1,'*) ;;
+*) fail "unsupported protocol version" ;;
+esac
+
+state=$(field state)
+[ -n "$state" ] || fail "missing option state"
+
+case $(field op) in
+list)
+	rrsets=$(cat "$state/rrsets.json" 2>/dev/null || echo '[]')
+	printf '{"version":1,"rrsets":%s}\n' "$rrsets"
+	;;
+apply)
+	printf '%s\n' "$request" | sed 's/.*"changes":\({.*}\)}$/\1/' >>"$state/changes.log"
+	printf '{"version":1,"id":"%s"}\n' "$(wc -l <"$state/changes.log" | tr -d ' ')"
+	;;
+wait)
+	id=$(field id)
+	[ "$(sed -n "${id}p" "$state/changes.log")" ] || fail "unknown change $id"
+	printf '{"version":1}\n'
+	;;
+*)
+	fail "unknown op"
+	;;
+esac
@@ -0,0 +1,584 @@
+// CDH: CertBot DANE hook
+// Copyright (C) 2019-2024  Yishen Miao
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneToken is a token of a master file entry and its offset in the entry.
+type zoneToken struct {
+	Text  string
+	Start int
+}
+
+// zoneEntry is one entry of a master file: a record, a directive, or a
+// blank or comment line. Text is kept verbatim so that the file can be
+// written back unchanged outside the touched records.
+type zoneEntry struct {
+	Text      string
+	Tokens    []zoneToken
+	RR        dns.RR
+	Ownerless bool
+}
+
+// splitEntries splits a master file into entries. An entry ends at a newline
+// outside of parentheses, quotes and comments.
+func splitEntries(data string) []string {
+	var entries []string
+	start, depth := 0, 0
+	quoted, comment := false, false
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case comment:
+			if c != '\n' {
+				continue
+			}
+			comment = false
+		case quoted:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				quoted = false
+			}
+			continue
+		}
+
+		switch c {
+		case '\\':
+			i++
+		case ';':
+			comment = true
+		case '"':
+			quoted = true
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case '\n':
+			if depth == 0 {
+				entries = append(entries, data[start:i+1])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(data) {
+		entries = append(entries, data[start:])
+	}
+
+	return entries
+}
+
+// tokenize splits an entry into tokens, dropping comments and parentheses.
+// Quoted strings are kept as one token including the quotes.
+func tokenize(entry string) []zoneToken {
+	var tokens []zoneToken
+	start := -1
+
+	flush := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, zoneToken{Text: entry[start:end], Start: start})
+			start = -1
+		}
+	}
+
+	for i := 0; i < len(entry); i++ {
+		switch c := entry[i]; c {
+		case ' ', '\t', '\r', '\n', '(', ')':
+			flush(i)
+		case ';':
+			flush(i)
+			for i < len(entry) && entry[i] != '\n' {
+				i++
+			}
+		case '"':
+			flush(i)
+			start = i
+			for i++; i < len(entry) && entry[i] != '"'; i++ {
+				if entry[i] == '\\' {
+					i++
+				}
+			}
+			flush(min(i+1, len(entry)))
+		case '\\':
+			if start < 0 {
+				start = i
+			}
+			i++
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	flush(len(entry))
+
+	return tokens
+}
+
+// ttlUnits holds the BIND time units accepted in TTLs.
+var ttlUnits = map[byte]uint32{
+	's': 1,
+	'm': 60,
+	'h': 60 * 60,
+	'd': 24 * 60 * 60,
+	'w': 7 * 24 * 60 * 60,
+}
+
+// parseTTL parses a TTL in seconds or in BIND units, such as 1h30m.
+func parseTTL(s string) (uint32, bool) {
+	var ttl, n uint64
+	digits := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + uint64(c-'0')
+			digits = true
+		case digits:
+			u, ok := ttlUnits[c|0x20]
+			if !ok {
+				return 0, false
+			}
+			ttl += n * uint64(u)
+			n, digits = 0, false
+		default:
+			return 0, false
+		}
+		if ttl+n > 1<<32-1 {
+			return 0, false
+		}
+	}
+	if s == "" {
+		return 0, false
+	}
+
+	return uint32(ttl + n), true
+}
+
+// absName makes name fully qualified relative to origin.
+func absName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case dns.IsFqdn(name):
+		return name
+	case origin == ".":
+		return name + "."
+	default:
+		return name + "." + origin
+	}
+}
+
+// parseZone splits a master file into entries and parses each record with
+// the origin, default TTL and owner name in effect at its position.
+func parseZone(data, origin, file string) ([]*zoneEntry, error) {
+	var entries []*zoneEntry
+	var ttl uint32 = 3600
+	owner := origin
+
+	for _, text := range splitEntries(data) {
+		e := &zoneEntry{Text: text, Tokens: tokenize(text)}
+		entries = append(entries, e)
+
+		if len(e.Tokens) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(e.Tokens[0].Text) {
+		case "$ORIGIN":
+			if len(e.Tokens) > 1 {
+				origin = absName(e.Tokens[1].Text, origin)
+			}
+			continue
+		case "$TTL":
+			if len(e.Tokens) > 1 {
+				t, ok := parseTTL(e.Tokens[1].Text)
+				if !ok {
+					return nil, fmt.Errorf("%s: invalid $TTL %s", file, e.Tokens[1].Text)
+				}
+				ttl = t
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Tokens[0].Text, "$") {
+			continue
+		}
+
+		src := text
+		if text[0] == ' ' || text[0] == '\t' {
+			e.Ownerless = true
+			src = owner + src
+		}
+
+		zp := dns.NewZoneParser(
+			strings.NewReader(fmt.Sprintf("$TTL %d\n%s", ttl, src)),
+			origin,
+			file,
+		)
+		rr, ok := zp.Next()
+		if err := zp.Err(); err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		e.RR = rr
+		owner = rr.Header().Name
+	}
+
+	return entries, nil
+}
+
+// nextSerial returns the SOA serial following s. In date mode the serial has
+// the form YYYYMMDDnn, otherwise it is incremented.
+func nextSerial(s uint32, mode string, now time.Time) (uint32, error) {
+	switch mode {
+	case "", "increment":
+		return s + 1, nil
+	case "date":
+		d, err := strconv.ParseUint(now.UTC().Format("20060102")+"00", 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		if uint32(d) > s {
+			return uint32(d), nil
+		}
+		return s + 1, nil
+	default:
+		return 0, fmt.Errorf("unknown serial mode %q", mode)
+	}
+}
+
+// setSerial rewrites the serial of a SOA entry in place.
+func setSerial(e *zoneEntry, serial uint32) error {
+	for i, t := range e.Tokens {
+		if strings.EqualFold(t.Text, "SOA") && i+3 < len(e.Tokens) {
+			s := e.Tokens[i+3]
+			e.Text = e.Text[:s.Start] + strconv.FormatUint(uint64(serial), 10) + e.Text[s.Start+len(s.Text):]
+			e.RR.(*dns.SOA).Serial = serial
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot find serial of %s", e.RR.Header().Name)
+}
+
+// zonefileProvider manages TLSA records in a local master file. Only the
+// file itself is rewritten; records from $INCLUDE files are read but never
+// changed.
+type zonefileProvider struct {
+	zone   string
+	file   string
+	serial string
+	reload []string
+	signer *zoneSigner
+	now    func() time.Time
+}
+
+// newZonefileProvider creates a master file provider. The zone is the
+// origin of the file given by the file option.
+func newZonefileProvider(ctx context.Context, cfg providerConfig) (provider, error) {
+	file, err := cfg.Options.Require("file")
+	if err != nil {
+		return nil, err
+	}
+
+	serial := cfg.Options["serial"]
+	if _, err := nextSerial(0, serial, time.Now()); err != nil {
+		return nil, err
+	}
+
+	p := &zonefileProvider{
+		zone:   dns.Fqdn(cfg.Zone),
+		file:   filepath.Clean(file),
+		serial: serial,
+		reload: strings.Fields(cfg.Options["reload"]),
+		now:    time.Now,
+	}
+
+	if key, ok := cfg.Options["sign"]; ok {
+		validity := uint32(30 * 24 * 60 * 60)
+		if v, ok := cfg.Options["validity"]; ok {
+			if validity, ok = parseTTL(v); !ok {
+				return nil, fmt.Errorf("invalid validity %s", v)
+			}
+		}
+
+		p.signer, err = readZoneSigner(key, time.Duration(validity)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// readZoneRRs parses a zone, following $INCLUDE directives relative to file.
+func readZoneRRs(r io.Reader, origin, file string) ([]dns.RR, error) {
+	zp := dns.NewZoneParser(r, origin, file)
+	zp.SetIncludeAllowed(true)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return rrs, nil
+}
+
+// List parses the zone, following $INCLUDE directives, and returns its TLSA
+// and TXT resource record sets.
+func (p *zonefileProvider) List(ctx context.Context) ([]*rrset, error) {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	all, err := readZoneRRs(f, p.zone, p.file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for _, rr := range all {
+		if managedType(dns.TypeToString[rr.Header().Rrtype]) {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return fromRRs(rrs), nil
+}
+
+// rrsetKey identifies an RRset by owner name and type.
+func rrsetKey(name, t string) string {
+	return strings.ToLower(dns.Fqdn(name)) + " " + strings.ToUpper(t)
+}
+
+// rrKey returns the key of the RRset a record belongs to. Signatures are
+// grouped by the type they cover, so that each can be replaced on its own.
+func rrKey(rr dns.RR) string {
+	h := rr.Header()
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		return rrsetKey(h.Name, "RRSIG "+dns.TypeToString[sig.TypeCovered])
+	}
+	return rrsetKey(h.Name, dns.TypeToString[h.Rrtype])
+}
+
+// keyOf returns the key of an RRset, see rrKey.
+func keyOf(r *rrset) string {
+	if strings.EqualFold(r.Type, "RRSIG") && len(r.Rrdatas) > 0 {
+		if f := strings.Fields(r.Rrdatas[0]); len(f) > 0 {
+			return rrsetKey(r.Name, "RRSIG "+f[0])
+		}
+	}
+	return rrsetKey(r.Name, r.Type)
+}
+
+// rewrite applies the changeset to the entries of the master file and
+// returns the new contents. New records take the place of the RRset they
+// replace, or are appended to the end of the file. If bump is set, the SOA
+// serial is advanced and returned.
+func (p *zonefileProvider) rewrite(entries []*zoneEntry, c *changeset, bump bool) (string, uint32, error) {
+	deleted := make(map[string]bool)
+	for _, r := range c.Deletions {
+		deleted[keyOf(r)] = false
+	}
+	additions := make(map[string][]*rrset)
+	for _, r := range c.Additions {
+		k := keyOf(r)
+		additions[k] = append(additions[k], r)
+	}
+
+	var b strings.Builder
+	var soa *dns.SOA
+	owner := ""
+
+	writeAdditions := func(k string) error {
+		for _, r := range additions[k] {
+			rrs, err := r.RRs()
+			if err != nil {
+				return err
+			}
+			for _, rr := range rrs {
+				b.WriteString(rr.String() + "\n")
+			}
+			owner = dns.Fqdn(r.Name)
+		}
+		delete(additions, k)
+		return nil
+	}
+
+	for _, e := range entries {
+		if e.RR != nil {
+			h := e.RR.Header()
+			k := rrKey(e.RR)
+
+			if _, ok := deleted[k]; ok {
+				deleted[k] = true
+				if err := writeAdditions(k); err != nil {
+					return "", 0, err
+				}
+				continue
+			}
+
+			if bump && h.Rrtype == dns.TypeSOA && soa == nil && strings.EqualFold(h.Name, p.zone) {
+				soa = e.RR.(*dns.SOA)
+				next, err := nextSerial(soa.Serial, p.serial, p.now())
+				if err != nil {
+					return "", 0, err
+				}
+				if err := setSerial(e, next); err != nil {
+					return "", 0, err
+				}
+			}
+
+			// Name the owner if the record inherited it from a removed one.
+			if e.Ownerless && !strings.EqualFold(owner, h.Name) {
+				b.WriteString(h.Name)
+			}
+			owner = h.Name
+		}
+		b.WriteString(e.Text)
+	}
+
+	if bump && soa == nil {
+		return "", 0, fmt.Errorf("%s: no SOA record for %s", p.file, p.zone)
+	}
+	for k, found := range deleted {
+		if !found {
+			return "", 0, fmt.Errorf("%s: RRset %s is not in the file", p.file, k)
+		}
+	}
+
+	if s := b.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		b.WriteString("\n")
+	}
+	for _, r := range c.Additions {
+		if err := writeAdditions(keyOf(r)); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var serial uint32
+	if soa != nil {
+		serial = soa.Serial
+	}
+
+	return b.String(), serial, nil
+}
+
+// Apply rewrites the master file with the changeset, bumps the SOA serial,
+// re-signs the zone if a signing key is set, and runs the reload command.
+// It returns the new serial.
+func (p *zonefileProvider) Apply(ctx context.Context, c *changeset) (string, error) {
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := parseZone(string(data), p.zone, p.file)
+	if err != nil {
+		return "", err
+	}
+
+	text, serial, err := p.rewrite(entries, c, true)
+	if err != nil {
+		return "", err
+	}
+
+	if p.signer != nil {
+		if text, err = p.resign(text, c); err != nil {
+			return "", err
+		}
+	}
+
+	if err := writeFileAtomic(p.file, []byte(text)); err != nil {
+		return "", err
+	}
+
+	if len(p.reload) > 0 {
+		out, err := exec.CommandContext(ctx, p.reload[0], p.reload[1:]...).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w: %s", strings.Join(p.reload, " "), err, out)
+		}
+	}
+
+	return strconv.FormatUint(uint64(serial), 10), nil
+}
+
+// Wait returns immediately as the file is rewritten synchronously.
+func (p *zonefileProvider) Wait(ctx context.Context, id string) error {
+	return nil
+}
+
+// writeFileAtomic replaces the file with data through a temporary file in
+// the same directory, keeping the permissions, owner and group of the
+// original.
+func writeFileAtomic(name string, data []byte) error {
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := copyOwner(f, info); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
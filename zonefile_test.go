@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testZone = `; example.com master file
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024122801 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		3600 )     ; minimum
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+$INCLUDE extra.zone
+_443._tcp	300	IN	TLSA	3 1 1 0000 ; old leaf
+	300	IN	TLSA	2 1 1 1111
+	IN	TXT	"kept; not a comment"
+$ORIGIN mail.example.com.
+@	IN	A	192.0.2.2 ; mail host
+`
+
+const testExtra = `_25._tcp.mail	IN	TLSA	3 1 1 2222
+`
+
+func writeTestZone(t *testing.T) string {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "example.com.zone")
+	assert.NoError(t, os.WriteFile(f, []byte(testZone), 0o640), "Expected no error")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "extra.zone"), []byte(testExtra), 0o640), "Expected no error")
+	return f
+}
+
+func TestSplitEntries(t *testing.T) {
+	entries := splitEntries(testZone)
+
+	assert.Len(t, entries, 11, "Expected one entry per record or line")
+	assert.Contains(t, entries[2], "3600 )     ; minimum\n", "Expected SOA to span lines")
+}
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("@ IN TXT \"a; b\" ( c ) ; comment\n")
+
+	var texts []string
+	for _, tk := range tokens {
+		texts = append(texts, tk.Text)
+	}
+	assert.Equal(t, []string{"@", "IN", "TXT", "\"a; b\"", "c"}, texts, "Expected tokens to match")
+}
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		in  string
+		ttl uint32
+		ok  bool
+	}{
+		{"3600", 3600, true},
+		{"1h", 3600, true},
+		{"1h30m", 5400, true},
+		{"1W", 604800, true},
+		{"", 0, false},
+		{"h", 0, false},
+		{"1x", 0, false},
+	}
+
+	for _, tt := range tests {
+		ttl, ok := parseTTL(tt.in)
+		assert.Equal(t, tt.ok, ok, "Expected validity of %q", tt.in)
+		assert.Equal(t, tt.ttl, ttl, "Expected TTL of %q", tt.in)
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	s, err := nextSerial(7, "", now)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, uint32(8), s, "Expected serial to be incremented")
+
+	s, err = nextSerial(2024122801, "date", now)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, uint32(2025010200), s, "Expected serial to be today")
+
+	s, err = nextSerial(2025010200, "date", now)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, uint32(2025010201), s, "Expected serial to be incremented")
+
+	_, err = nextSerial(1, "bogus", now)
+	assert.Error(t, err, "Expected unknown mode to fail")
+}
+
+func TestZonefileList(t *testing.T) {
+	f := writeTestZone(t)
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com",
+		Options: options{"file": f},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err := p.List(context.Background())
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, []*rrset{
+		{
+			Name:    "_25._tcp.mail.example.com.",
+			Type:    "TLSA",
+			TTL:     3600,
+			Rrdatas: []string{"3 1 1 2222"},
+		},
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TLSA",
+			TTL:     300,
+			Rrdatas: []string{"3 1 1 0000", "2 1 1 1111"},
+		},
+		{
+			Name:    "_443._tcp.example.com.",
+			Type:    "TXT",
+			TTL:     3600,
+			Rrdatas: []string{`"kept; not a comment"`},
+		},
+	}, rr, "Expected TLSA and TXT RRsets from the file and its includes")
+}
+
+func TestZonefileApply(t *testing.T) {
+	f := writeTestZone(t)
+	marker := filepath.Join(filepath.Dir(f), "reloaded")
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone: "example.com.",
+		Options: options{
+			"file":   f,
+			"serial": "date",
+			"reload": "touch " + marker,
+		},
+	})
+	assert.NoError(t, err, "Expected no error")
+	p.(*zonefileProvider).now = func() time.Time {
+		return time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	}
+
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("abcdef", "123456", "example.com.", "www.example.com.")
+	cset, _ := newChange(rr, d, changeOptions{})
+	id, err := p.Apply(context.Background(), cset)
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "2025010200", id, "Expected new serial")
+	assert.FileExists(t, marker, "Expected reload command to run")
+
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, `; example.com master file
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2025010200 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		3600 )     ; minimum
+	IN	NS	ns1
+ns1	IN	A	192.0.2.1
+$INCLUDE extra.zone
+_443._tcp.example.com.	300	IN	TLSA	3 1 1 abcdef
+_443._tcp.example.com.	300	IN	TLSA	2 1 1 123456
+	IN	TXT	"kept; not a comment"
+$ORIGIN mail.example.com.
+@	IN	A	192.0.2.2 ; mail host
+_443._tcp.www.example.com.	300	IN	TLSA	3 1 1 abcdef
+_443._tcp.www.example.com.	300	IN	TLSA	2 1 1 123456
+`, string(data), "Expected only the TLSA RRsets and serial to change")
+
+	info, err := os.Stat(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm(), "Expected permissions to be kept")
+}
+
+func TestZonefileApplyDeleteOnly(t *testing.T) {
+	f := writeTestZone(t)
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"file": f},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	id, err := p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{{Name: "_443._tcp.example.com.", Type: "TLSA"}},
+	})
+
+	assert.NoError(t, err, "Expected no error")
+	assert.Equal(t, "2024122802", id, "Expected serial to be incremented")
+
+	data, _ := os.ReadFile(f)
+	assert.Contains(t, string(data), "$INCLUDE extra.zone\n_443._tcp.example.com.\tIN\tTXT", "Expected owner to be named")
+	assert.NotContains(t, string(data), "TLSA\t3 1 1 0000", "Expected TLSA RRset to be removed")
+}
+
+func TestZonefileApplyIncluded(t *testing.T) {
+	f := writeTestZone(t)
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"file": f},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	_, err = p.Apply(context.Background(), &changeset{
+		Deletions: []*rrset{{Name: "_25._tcp.mail.example.com.", Type: "TLSA"}},
+	})
+
+	assert.ErrorContains(t, err, "not in the file", "Expected included RRsets to be refused")
+
+	data, _ := os.ReadFile(f)
+	assert.Equal(t, testZone, string(data), "Expected file to be unchanged")
+}
+
+func TestZonefileUnchanged(t *testing.T) {
+	f := writeTestZone(t)
+
+	p, err := newZonefileProvider(context.Background(), providerConfig{
+		Zone:    "example.com.",
+		Options: options{"file": f},
+	})
+	assert.NoError(t, err, "Expected no error")
+
+	d := testTLSA("ABCDEF", "123456", "example.com.")
+	rr, err := p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+	cset, _ := newChange(rr, d, changeOptions{})
+	_, err = p.Apply(context.Background(), cset)
+	assert.NoError(t, err, "Expected no error")
+
+	rr, err = p.List(context.Background())
+	assert.NoError(t, err, "Expected no error")
+	cset, _ = newChange(rr, d, changeOptions{})
+	assert.True(t, cset.Empty(), "Expected nothing to change on the second run")
+
+	data, err := os.ReadFile(f)
+	assert.NoError(t, err, "Expected no error")
+	assert.Contains(t, string(data), "2024122802 ; serial", "Expected serial to be bumped once")
+}